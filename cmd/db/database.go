@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gogaeva/balancer/datastore"
 	"github.com/gogaeva/balancer/httptools"
@@ -14,23 +16,58 @@ import (
 
 var dir = flag.String("dir", ".", "database directory")
 var port = flag.Int("port", 18080, "database port")
+var drainTime = flag.Duration("shutdown-timeout", 15*time.Second, "how long active requests may take to finish on shutdown")
+var mergeSegments = flag.Int("merge-segments", datastore.DefaultCompaction.Segments, "number of full segments that starts a merge, 0 to disable")
+var mergeGarbage = flag.Float64("merge-garbage-ratio", datastore.DefaultCompaction.GarbageRatio,
+	"share of the full segments taken by overwritten and deleted records that starts a merge, 0 to disable")
+var syncMode = flag.String("sync", "none", "when writes are synced to disk before they are acknowledged: none, write or group")
+var syncInterval = flag.Duration("sync-interval", 10*time.Millisecond, "longest time a write waits for its group commit")
+var syncWrites = flag.Int("sync-writes", 100, "number of writes that start a group commit at once, 0 for no limit")
+
+var syncModes = map[string]datastore.SyncMode{
+	"none":  datastore.NoSync,
+	"write": datastore.SyncEveryWrite,
+	"group": datastore.GroupCommit,
+}
+
+var latencyMetric = httptools.DefaultRegistry.Histogram("db_operation_duration_seconds",
+	"Latency of the database operations.", httptools.DefaultBuckets, "operation")
 
 func main() {
 	flag.Parse()
 
-	db, err := datastore.NewDb(*dir, datastore.DefaultSegmentSize)
+	mode, ok := syncModes[*syncMode]
+	if !ok {
+		log.Fatalf("Unknown sync mode %q, use none, write or group", *syncMode)
+	}
+	db, err := datastore.NewDb(*dir, datastore.DefaultSegmentSize, datastore.Compaction(datastore.CompactionPolicy{
+		Segments:     *mergeSegments,
+		GarbageRatio: *mergeGarbage,
+	}), datastore.Durability(datastore.SyncPolicy{
+		Mode:     mode,
+		Interval: *syncInterval,
+		Writes:   *syncWrites,
+	}))
 	if err != nil {
 		log.Fatalf("Database initialization failed: %s", err)
 	}
 
+	registerMetrics(db)
+
 	h := new(http.ServeMux)
+	h.Handle("/metrics", httptools.DefaultRegistry)
 
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "application/json")
 		key := strings.Split(r.URL.Path, "/db/")[1]
+		if trace, ok := httptools.TraceFrom(r.Context()); ok {
+			log.Printf("%s %s request [%s] trace [%s] parent [%s]", r.Method, key, trace.RequestID, trace.TraceID, trace.ParentID)
+		}
 		switch r.Method {
 		case http.MethodGet:
+			start := time.Now()
 			value, err := db.Get(key)
+			latencyMetric.ObserveSince(start, "get")
 			if err != nil {
 				switch err {
 				case datastore.ErrNotFound:
@@ -57,18 +94,72 @@ func main() {
 				rw.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			start := time.Now()
 			err = db.Put(key, val.Value)
+			latencyMetric.ObserveSince(start, "put")
 			if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 			rw.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			start := time.Now()
+			err := db.Delete(key)
+			latencyMetric.ObserveSince(start, "delete")
+			if err != nil {
+				switch err {
+				case datastore.ErrNotFound:
+					rw.WriteHeader(http.StatusNotFound)
+				default:
+					rw.WriteHeader(http.StatusInternalServerError)
+				}
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
 		default:
 			rw.WriteHeader(http.StatusBadRequest)
 		}
 	})
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, httptools.Tracing(httptools.Instrument(h)))
 	server.Start()
 	signal.WaitForTerminationSignal()
+	httptools.Shutdown(*drainTime, server)
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close the database: %s", err)
+	}
+}
+
+func registerMetrics(db *datastore.Db) {
+	// The gauges read one snapshot taken before every scrape.
+	var (
+		mu    sync.Mutex
+		stats datastore.Stats
+	)
+	snapshot := func() datastore.Stats {
+		mu.Lock()
+		defer mu.Unlock()
+		return stats
+	}
+	httptools.DefaultRegistry.OnScrape(func() {
+		s := db.Stats()
+		mu.Lock()
+		stats = s
+		mu.Unlock()
+	})
+	httptools.DefaultRegistry.GaugeFunc("db_segments", "Segment files of the database.", func() float64 {
+		return float64(snapshot().Segments)
+	})
+	httptools.DefaultRegistry.GaugeFunc("db_size_bytes", "Size of the segment files on disk.", func() float64 {
+		return float64(snapshot().Bytes)
+	})
+	httptools.DefaultRegistry.GaugeFunc("db_garbage_bytes", "Space of the overwritten and deleted records a merge would free.", func() float64 {
+		return float64(snapshot().Garbage)
+	})
+	httptools.DefaultRegistry.CounterFunc("db_merges_total", "Segment merges since the start.", func() float64 {
+		return float64(snapshot().Merges)
+	})
+	httptools.DefaultRegistry.CounterFunc("db_merge_duration_seconds_total", "Time spent merging segments.", func() float64 {
+		return snapshot().MergeTime.Seconds()
+	})
 }
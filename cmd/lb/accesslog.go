@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogaeva/balancer/httptools"
+)
+
+const (
+	jsonFormat   = "json"
+	logfmtFormat = "logfmt"
+)
+
+// accessRecord is a line of the access log. The handlers serving the
+// request fill it in as they go.
+type accessRecord struct {
+	Time             time.Time
+	Client           string
+	Method           string
+	Path             string
+	RequestID        string
+	Pool             string
+	Backend          string
+	Status           int
+	UpstreamStatus   int
+	Bytes            int64
+	Duration         time.Duration
+	UpstreamDuration time.Duration
+	Retries          int
+}
+
+type accessRecordKey struct{}
+
+// recordOf returns the access log record of r, nil if it isn't logged.
+func recordOf(r *http.Request) *accessRecord {
+	record, _ := r.Context().Value(accessRecordKey{}).(*accessRecord)
+	return record
+}
+
+// forwarded records an attempt to forward the request to server. The
+// record may be nil.
+func (record *accessRecord) forwarded(server *Server, attempt, status int, start time.Time) {
+	if record == nil {
+		return
+	}
+	record.Backend = server.Addr
+	record.Retries = attempt
+	record.UpstreamStatus = status
+	record.UpstreamDuration = time.Since(start)
+}
+
+// AccessLog writes a line per request in JSON or logfmt.
+type AccessLog struct {
+	sync.Mutex
+	out    io.Writer
+	format string
+}
+
+func NewAccessLog(out io.Writer, format string) (*AccessLog, error) {
+	if format != jsonFormat && format != logfmtFormat {
+		return nil, fmt.Errorf("unknown access log format %q, use %s or %s", format, jsonFormat, logfmtFormat)
+	}
+	return &AccessLog{out: out, format: format}, nil
+}
+
+// Handler logs the requests served by next. A nil log passes them through.
+func (l *AccessLog) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		record := &accessRecord{
+			Time:      time.Now(),
+			Client:    r.RemoteAddr,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RequestID: r.Header.Get(httptools.RequestIDHeader),
+		}
+		counter := &countingWriter{ResponseWriter: rw}
+		next.ServeHTTP(counter, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record)))
+		record.Duration = time.Since(record.Time)
+		record.Status = counter.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.Bytes = counter.bytes
+		l.write(record)
+	})
+}
+
+func (l *AccessLog) write(record *accessRecord) {
+	var line []byte
+	if l.format == jsonFormat {
+		line = record.json()
+	} else {
+		line = record.logfmt()
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+func (record *accessRecord) fields() []accessField {
+	return []accessField{
+		{"time", record.Time.UTC().Format(time.RFC3339Nano)},
+		{"client", record.Client},
+		{"method", record.Method},
+		{"path", record.Path},
+		{"request_id", record.RequestID},
+		{"pool", record.Pool},
+		{"backend", record.Backend},
+		{"status", record.Status},
+		{"upstream_status", record.UpstreamStatus},
+		{"bytes", record.Bytes},
+		{"duration", record.Duration.Seconds()},
+		{"upstream_duration", record.UpstreamDuration.Seconds()},
+		{"retries", record.Retries},
+	}
+}
+
+type accessField struct {
+	name  string
+	value interface{}
+}
+
+func (record *accessRecord) json() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range record.fields() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.name)
+		value, _ := json.Marshal(field.value)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func (record *accessRecord) logfmt() []byte {
+	var buf bytes.Buffer
+	for i, field := range record.fields() {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(field.name)
+		buf.WriteByte('=')
+		switch value := field.value.(type) {
+		case string:
+			if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, isControl) >= 0 {
+				value = strconv.Quote(value)
+			}
+			buf.WriteString(value)
+		case float64:
+			buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+		default:
+			fmt.Fprint(&buf, value)
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+// countingWriter records the status and the size of a response. It keeps
+// streaming and upgrades working by passing Flush and Hijack through.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AccessLogSuite struct{}
+
+var _ = Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) TestServe(c *C) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	alive := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer alive.Close()
+	lb := &Balancer{
+		Mutex: new(sync.Mutex),
+		servers: []*Server{
+			{Addr: strings.TrimPrefix(dead.URL, "http://"), Alive: true},
+			{Addr: strings.TrimPrefix(alive.URL, "http://"), Connections: 1, Alive: true},
+		},
+		name: "api",
+	}
+
+	var out bytes.Buffer
+	accessLog, err := NewAccessLog(&out, jsonFormat)
+	c.Assert(err, IsNil)
+	h := accessLog.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		recordOf(r).Pool = lb.name
+		serve(lb, RetryPolicy{Attempts: 1, Budget: NewRetryBudget(1, 10)}, rw, r)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=a", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Request-ID", "42")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	c.Check(rw.Code, Equals, http.StatusCreated)
+
+	var line map[string]interface{}
+	c.Assert(json.Unmarshal(out.Bytes(), &line), IsNil)
+	c.Check(line["client"], Equals, "10.0.0.1:5000")
+	c.Check(line["method"], Equals, "GET")
+	c.Check(line["path"], Equals, "/api/v1/some-data")
+	c.Check(line["request_id"], Equals, "42")
+	c.Check(line["pool"], Equals, "api")
+	c.Check(line["backend"], Equals, strings.TrimPrefix(alive.URL, "http://"))
+	c.Check(line["status"], Equals, float64(http.StatusCreated))
+	c.Check(line["upstream_status"], Equals, float64(http.StatusCreated))
+	c.Check(line["bytes"], Equals, float64(5))
+	c.Check(line["retries"], Equals, float64(1))
+	c.Check(line["duration"].(float64) >= line["upstream_duration"].(float64), Equals, true)
+}
+
+func (s *AccessLogSuite) TestLogfmt(c *C) {
+	record := &accessRecord{
+		Time:             time.Date(2021, 4, 5, 18, 3, 0, 0, time.UTC),
+		Client:           "10.0.0.1:5000",
+		Method:           "GET",
+		Path:             "/some path",
+		Status:           http.StatusServiceUnavailable,
+		Duration:         1500 * time.Millisecond,
+		UpstreamDuration: 0,
+	}
+	c.Check(string(record.logfmt()), Equals, `time=2021-04-05T18:03:00Z client=10.0.0.1:5000 method=GET path="/some path" `+
+		`request_id="" pool="" backend="" status=503 upstream_status=0 bytes=0 duration=1.5 upstream_duration=0 retries=0`+"\n")
+
+	_, err := NewAccessLog(ioutil.Discard, "xml")
+	c.Check(err, NotNil)
+}
+
+func (s *AccessLogSuite) TestRotation(c *C) {
+	dir, err := ioutil.TempDir("", "lb-access-log")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	file, err := openRotatingFile(path, 10, 2)
+	c.Assert(err, IsNil)
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(file.Close(), IsNil)
+
+	read := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+	c.Check(read(path), Equals, "fourth\n")
+	c.Check(read(path+".1"), Equals, "third\n")
+	c.Check(read(path+".2"), Equals, "second\n")
+	_, err = os.Stat(path + ".3")
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	file, err = openRotatingFile(path, 10, 2)
+	c.Assert(err, IsNil)
+	_, err = file.Write([]byte("fifth\n"))
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+	c.Check(read(path), Equals, "fifth\n")
+	c.Check(read(path+".1"), Equals, "fourth\n")
+}
+
+func (s *AccessLogSuite) TestFailedRotation(c *C) {
+	dir, err := ioutil.TempDir("", "lb-access-log")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	read := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// A directory with a file in it can't be replaced by the log.
+	c.Assert(os.MkdirAll(filepath.Join(path+".1", "keep"), 0o755), IsNil)
+	file, err := openRotatingFile(path, 10, 1)
+	c.Assert(err, IsNil)
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err := file.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	c.Check(read(path), Equals, "first\nsecond\n")
+
+	// The rotation waits for another 10 bytes before trying again.
+	c.Assert(os.RemoveAll(path+".1"), IsNil)
+	for _, line := range []string{"third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(file.Close(), IsNil)
+	c.Check(read(path), Equals, "fourth\n")
+	c.Check(read(path+".1"), Equals, "first\nsecond\nthird\n")
+}
+
+func (s *AccessLogSuite) TestFailedReopen(c *C) {
+	dir, err := ioutil.TempDir("", "lb-access-log")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	file, err := openRotatingFile(path, 10, 2)
+	c.Assert(err, IsNil)
+	_, err = file.Write([]byte("first\n"))
+	c.Assert(err, IsNil)
+
+	// As if the new file couldn't be opened after the old one was moved
+	// aside and back.
+	c.Assert(os.Rename(path, path+".1"), IsNil)
+	file.moved = true
+	_, err = file.Write([]byte("second\n"))
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+
+	data, err := ioutil.ReadFile(path + ".1")
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "first\n")
+	data, err = ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "second\n")
+	_, err = os.Stat(path + ".2")
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogaeva/balancer/httptools"
+)
+
+type serverStatus struct {
+	Addr        string       `json:"addr"`
+	Alive       bool         `json:"alive"`
+	Disabled    bool         `json:"disabled"`
+	Draining    bool         `json:"draining"`
+	Weight      int          `json:"weight"`
+	Connections int          `json:"connections"`
+	MaxConns    int          `json:"maxConnections,omitempty"`
+	Requests    int64        `json:"requests"`
+	Errors      int64        `json:"errors"`
+	Timeouts    int64        `json:"timeouts"`
+	Circuit     string       `json:"circuit"`
+	Health      healthStatus `json:"health"`
+}
+
+type healthStatus struct {
+	Checked bool     `json:"checked"`
+	OK      bool     `json:"ok"`
+	Reason  string   `json:"reason,omitempty"`
+	At      string   `json:"at,omitempty"`
+	Latency Duration `json:"latency"`
+}
+
+func statusOf(server Server) serverStatus {
+	status := serverStatus{
+		Addr:        server.Addr,
+		Alive:       server.Alive,
+		Disabled:    server.Disabled,
+		Draining:    server.Draining,
+		Weight:      server.Weight,
+		Connections: server.Connections,
+		MaxConns:    server.MaxConnections,
+		Requests:    server.Requests,
+		Errors:      server.Errors,
+		Timeouts:    server.Timeouts,
+		Circuit:     server.breaker.state.String(),
+	}
+	if last := server.health.last; !last.At.IsZero() {
+		status.Health = healthStatus{
+			Checked: true,
+			OK:      last.OK,
+			Reason:  last.Reason,
+			At:      last.At.Format(time.RFC3339),
+			Latency: Duration(last.Latency),
+		}
+	}
+	return status
+}
+
+type limitsStatus struct {
+	Rate     *rateStatus           `json:"rate"`
+	InFlight *inFlightStatus       `json:"inFlight"`
+	Pools    map[string]poolLimits `json:"pools"`
+}
+
+type rateStatus struct {
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+	Key      string  `json:"key"`
+	Clients  int     `json:"clients"`
+	Rejected int64   `json:"rejected"`
+}
+
+type inFlightStatus struct {
+	Max      int   `json:"max"`
+	Current  int   `json:"current"`
+	Rejected int64 `json:"rejected"`
+}
+
+// poolLimits counts the requests rejected as all backends of a pool were
+// at their connection limits and the ones waiting for a backend.
+type poolLimits struct {
+	Rejected int64 `json:"rejected"`
+	Queued   int   `json:"queued"`
+}
+
+func statusOfLimits(router *Router, limits Limits) limitsStatus {
+	status := limitsStatus{Pools: map[string]poolLimits{}}
+	if l := limits.Rate; l != nil {
+		l.Lock()
+		status.Rate = &rateStatus{
+			Rate:     l.rate,
+			Burst:    int(l.burst),
+			Key:      l.spec,
+			Clients:  len(l.buckets),
+			Rejected: l.rejected,
+		}
+		l.Unlock()
+	}
+	if l := limits.InFlight; l != nil {
+		l.Lock()
+		status.InFlight = &inFlightStatus{Max: l.max, Current: l.current, Rejected: l.rejected}
+		l.Unlock()
+	}
+	for _, name := range router.Pools() {
+		lb := router.Pool(name)
+		lb.Lock()
+		status.Pools[name] = poolLimits{Rejected: lb.rejected, Queued: len(lb.waiters)}
+		lb.Unlock()
+	}
+	return status
+}
+
+// adminHandler exposes the backend registries of the router pools:
+//
+//	GET    /servers                list the backends with their state
+//	POST   /servers                register {"addr": "host:port", "weight": 1}
+//	GET    /servers/{addr}         show a single backend
+//	DELETE /servers/{addr}         remove a backend immediately
+//	POST   /servers/{addr}/drain   remove a backend once it is idle
+//	POST   /servers/{addr}/disable stop sending requests to a backend
+//	POST   /servers/{addr}/enable  resume sending requests to a backend
+//	GET    /pools                  list the backends of every pool
+//	GET    /limits                 show the admission limits and rejections
+//	*      /pools/{name}/servers…  the above for a named pool
+//	GET    /metrics                metrics in the Prometheus text format
+//
+// The bare /servers endpoints manage the default pool.
+func adminHandler(router *Router, limits Limits) http.Handler {
+	h := new(http.ServeMux)
+
+	h.Handle("/metrics", httptools.DefaultRegistry)
+
+	pool := poolHandler(router.Pool(defaultPool))
+	h.Handle("/servers", pool)
+	h.Handle("/servers/", pool)
+	for _, name := range router.Pools() {
+		prefix := "/pools/" + name
+		h.Handle(prefix+"/", http.StripPrefix(prefix, poolHandler(router.Pool(name))))
+	}
+
+	h.HandleFunc("/pools", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		res := map[string][]serverStatus{}
+		for _, name := range router.Pools() {
+			res[name] = []serverStatus{}
+			for _, server := range router.Pool(name).Servers() {
+				res[name] = append(res[name], statusOf(server))
+			}
+		}
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(res)
+	})
+
+	h.HandleFunc("/limits", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(statusOfLimits(router, limits))
+	})
+
+	return h
+}
+
+// poolHandler serves the /servers endpoints of a single pool.
+func poolHandler(lb *Balancer) http.Handler {
+	h := new(http.ServeMux)
+
+	h.HandleFunc("/servers", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			res := []serverStatus{}
+			for _, server := range lb.Servers() {
+				res = append(res, statusOf(server))
+			}
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(res)
+		case http.MethodPost:
+			var server ServerConfig
+			err := json.NewDecoder(r.Body).Decode(&server)
+			if err != nil || server.Addr == "" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := lb.AddServer(server); err == errServerExists {
+				rw.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	h.HandleFunc("/servers/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		addr := strings.TrimPrefix(r.URL.Path, "/servers/")
+		action := ""
+		if i := strings.Index(addr, "/"); i >= 0 {
+			addr, action = addr[:i], addr[i+1:]
+		}
+
+		var err error
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			for _, server := range lb.Servers() {
+				if server.Addr == addr {
+					rw.WriteHeader(http.StatusOK)
+					_ = json.NewEncoder(rw).Encode(statusOf(server))
+					return
+				}
+			}
+			err = errServerUnknown
+		case r.Method == http.MethodDelete && action == "":
+			err = lb.RemoveServer(addr)
+		case r.Method == http.MethodPost && action == "drain":
+			err = lb.DrainServer(addr)
+		case r.Method == http.MethodPost && action == "disable":
+			err = lb.SetEnabled(addr, false)
+		case r.Method == http.MethodPost && action == "enable":
+			err = lb.SetEnabled(addr, true)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	return h
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AdminSuite struct{}
+
+var _ = Suite(&AdminSuite{})
+
+func (s *AdminSuite) TestAdmin(c *C) {
+	lb := NewBalancer([]ServerConfig{{Addr: "server:8000"}}, Options{})
+	router, err := NewRouter(nil, map[string]*Balancer{defaultPool: lb})
+	c.Assert(err, IsNil)
+	h := adminHandler(router, Limits{})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw
+	}
+
+	c.Check(do("POST", "/servers", `{"addr": "server:8001", "weight": 3}`).Code, Equals, http.StatusCreated)
+	c.Check(do("POST", "/servers", `{"addr": "server:8001"}`).Code, Equals, http.StatusConflict)
+	c.Check(do("POST", "/servers", `{}`).Code, Equals, http.StatusBadRequest)
+
+	c.Check(do("POST", "/servers/server:8000/disable", "").Code, Equals, http.StatusOK)
+	server, err := lb.GetServer(nil)
+	c.Assert(err, IsNil)
+	c.Check(server.Addr, Equals, "server:8001")
+	lb.acquire(server)
+	lb.report(server, nil)
+
+	rw := do("GET", "/servers", "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	var list []serverStatus
+	c.Assert(json.NewDecoder(rw.Body).Decode(&list), IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Check(list[0].Disabled, Equals, true)
+	c.Check(list[1].Weight, Equals, 3)
+	c.Check(list[1].Connections, Equals, 1)
+	c.Check(list[1].Requests, Equals, int64(1))
+	c.Check(list[1].Circuit, Equals, "closed")
+	c.Check(list[1].Health.Checked, Equals, false)
+
+	lb.recordHealth(server, healthResult{At: time.Now(), Reason: "connection refused"})
+	rw = do("GET", "/servers/server:8001", "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	var status serverStatus
+	c.Assert(json.NewDecoder(rw.Body).Decode(&status), IsNil)
+	c.Check(status.Health.Checked, Equals, true)
+	c.Check(status.Health.Reason, Equals, "connection refused")
+
+	c.Check(do("POST", "/servers/server:8000/enable", "").Code, Equals, http.StatusOK)
+	server, err = lb.GetServer(nil)
+	c.Assert(err, IsNil)
+	c.Check(server.Addr, Equals, "server:8000")
+
+	c.Check(do("POST", "/servers/server:8002/drain", "").Code, Equals, http.StatusNotFound)
+	c.Check(do("DELETE", "/servers/server:8000", "").Code, Equals, http.StatusOK)
+	c.Check(do("GET", "/servers/server:8000", "").Code, Equals, http.StatusNotFound)
+	c.Check(do("PUT", "/servers/server:8001", "").Code, Equals, http.StatusBadRequest)
+}
+
+func (s *AdminSuite) TestPools(c *C) {
+	router, err := NewRouter(nil, map[string]*Balancer{
+		defaultPool: NewBalancer([]ServerConfig{{Addr: "server:8000"}}, Options{}),
+		"db":        NewBalancer([]ServerConfig{{Addr: "db:18080"}}, Options{}),
+	})
+	c.Assert(err, IsNil)
+	h := adminHandler(router, Limits{})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw
+	}
+
+	c.Check(do("POST", "/pools/db/servers", `{"addr": "db:18081"}`).Code, Equals, http.StatusCreated)
+	c.Check(do("POST", "/pools/db/servers/db:18080/disable", "").Code, Equals, http.StatusOK)
+	c.Check(do("GET", "/pools/db/servers/server:8000", "").Code, Equals, http.StatusNotFound)
+	c.Check(do("GET", "/pools/cache/servers", "").Code, Equals, http.StatusNotFound)
+
+	rw := do("GET", "/pools", "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	var pools map[string][]serverStatus
+	c.Assert(json.NewDecoder(rw.Body).Decode(&pools), IsNil)
+	c.Check(pools[defaultPool], HasLen, 1)
+	c.Assert(pools["db"], HasLen, 2)
+	c.Check(pools["db"][0].Disabled, Equals, true)
+	c.Check(pools["db"][1].Addr, Equals, "db:18081")
+}
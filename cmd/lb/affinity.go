@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Fallbacks applied when the backend a session is pinned to is not
+// available.
+const (
+	rebalanceFallback = "rebalance"
+	rejectFallback    = "reject"
+)
+
+var errStickyServer = errors.New("sticky backend unavailable")
+
+// Affinity pins clients to the backend that served them first with a
+// cookie naming it. The cookie is signed, so clients cannot pick a backend
+// of their own. Every pool has a cookie of its own, see forPool.
+type Affinity struct {
+	Cookie string
+	Secret []byte
+	// Pool is signed along with the backend, so a pin is only valid in the
+	// pool that made it.
+	Pool string
+	// Fallback tells what to do when the pinned backend is not available:
+	// balance the request as usual and pin the client to the new backend,
+	// or reject it.
+	Fallback string
+	// MaxAge is the cookie lifetime, zero keeps it for the browser session.
+	MaxAge time.Duration
+}
+
+// NewAffinity configures sticky sessions. Without a secret a random one is
+// generated, so sessions don't survive a restart of the balancer.
+func NewAffinity(cookie, secret, fallback string, maxAge time.Duration) (*Affinity, error) {
+	if fallback != rebalanceFallback && fallback != rejectFallback {
+		return nil, fmt.Errorf("unknown fallback %q, use %s or %s", fallback, rebalanceFallback, rejectFallback)
+	}
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Affinity{Cookie: cookie, Secret: key, Fallback: fallback, MaxAge: maxAge}, nil
+}
+
+// forPool returns the affinity of the named pool. The cookies of the other
+// pools get the pool name appended, so the pins of a client in different
+// pools don't replace each other.
+func (a *Affinity) forPool(pool string) *Affinity {
+	if a == nil {
+		return nil
+	}
+	scoped := *a
+	scoped.Pool = pool
+	if pool != defaultPool {
+		scoped.Cookie = a.Cookie + "-" + strings.Map(cookieNameRune, pool)
+	}
+	return &scoped
+}
+
+// cookieNameRune replaces the characters a cookie name can't have.
+func cookieNameRune(r rune) rune {
+	if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-_.", r) {
+		return r
+	}
+	return '_'
+}
+
+// pinned returns the backend named by a validly signed cookie of r.
+func (a *Affinity) pinned(r *http.Request) (string, bool) {
+	if a == nil || r == nil {
+		return "", false
+	}
+	cookie, err := r.Cookie(a.Cookie)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	addr, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || !hmac.Equal([]byte(parts[1]), []byte(a.sign(string(addr)))) {
+		return "", false
+	}
+	return string(addr), true
+}
+
+// stick pins the client of r to server unless it already is. It replaces
+// the cookie of an earlier attempt, which is fine as a failed attempt
+// doesn't write any headers.
+func (a *Affinity) stick(rw http.ResponseWriter, r *http.Request, server *Server) {
+	if a == nil {
+		return
+	}
+	rw.Header().Del("Set-Cookie")
+	if addr, ok := a.pinned(r); ok && addr == server.Addr {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     a.Cookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(server.Addr)) + "." + a.sign(server.Addr),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.MaxAge > 0 {
+		cookie.MaxAge = int(a.MaxAge / time.Second)
+	}
+	http.SetCookie(rw, cookie)
+}
+
+func (a *Affinity) sign(addr string) string {
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(a.Pool))
+	mac.Write([]byte{0})
+	mac.Write([]byte(addr))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AffinitySuite struct{}
+
+var _ = Suite(&AffinitySuite{})
+
+func stickyRequest(rw *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func (s *AffinitySuite) TestCookie(c *C) {
+	affinity, err := NewAffinity("lb", "secret", rebalanceFallback, time.Hour)
+	c.Assert(err, IsNil)
+
+	rw := httptest.NewRecorder()
+	affinity.stick(rw, httptest.NewRequest(http.MethodGet, "/", nil), &Server{Addr: "server:8000"})
+	cookies := rw.Result().Cookies()
+	c.Assert(cookies, HasLen, 1)
+	c.Check(cookies[0].MaxAge, Equals, 3600)
+	c.Check(cookies[0].HttpOnly, Equals, true)
+
+	addr, ok := affinity.pinned(stickyRequest(rw))
+	c.Check(ok, Equals, true)
+	c.Check(addr, Equals, "server:8000")
+
+	req := stickyRequest(rw)
+	rw = httptest.NewRecorder()
+	affinity.stick(rw, req, &Server{Addr: "server:8000"})
+	c.Check(rw.Result().Cookies(), HasLen, 0)
+
+	other, err := NewAffinity("lb", "other", rebalanceFallback, 0)
+	c.Assert(err, IsNil)
+	_, ok = other.pinned(req)
+	c.Check(ok, Equals, false)
+
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	forged.AddCookie(&http.Cookie{Name: "lb", Value: "c2VydmVyOjgwMDE." + strings.SplitN(cookies[0].Value, ".", 2)[1]})
+	_, ok = affinity.pinned(forged)
+	c.Check(ok, Equals, false)
+
+	_, err = NewAffinity("lb", "", "random", 0)
+	c.Check(err, NotNil)
+}
+
+func (s *AffinitySuite) TestGetServer(c *C) {
+	for _, fallback := range []string{rebalanceFallback, rejectFallback} {
+		affinity, err := NewAffinity("lb", "secret", fallback, 0)
+		c.Assert(err, IsNil)
+		lb := &Balancer{
+			Mutex: new(sync.Mutex),
+			servers: []*Server{
+				{Addr: "server:8000", Alive: true},
+				{Addr: "server:8001", Connections: 5, Alive: true},
+			},
+			affinity: affinity,
+		}
+
+		rw := httptest.NewRecorder()
+		affinity.stick(rw, httptest.NewRequest(http.MethodGet, "/", nil), lb.servers[1])
+		server, err := lb.GetServer(stickyRequest(rw))
+		c.Assert(err, IsNil)
+		c.Check(server.Addr, Equals, "server:8001", Commentf(fallback))
+
+		lb.servers[1].Alive = false
+		server, err = lb.GetServer(stickyRequest(rw))
+		if fallback == rejectFallback {
+			c.Check(err, Equals, errStickyServer)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(server.Addr, Equals, "server:8000")
+		}
+	}
+}
+
+func (s *AffinitySuite) TestServe(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.SetCookie(rw, &http.Cookie{Name: "session", Value: "1"})
+	}))
+	defer backend.Close()
+	affinity, err := NewAffinity("lb", "secret", rebalanceFallback, 0)
+	c.Assert(err, IsNil)
+	lb := &Balancer{
+		Mutex:    new(sync.Mutex),
+		servers:  []*Server{{Addr: strings.TrimPrefix(backend.URL, "http://"), Alive: true}},
+		affinity: affinity,
+	}
+	policy := RetryPolicy{Budget: NewRetryBudget(0, 0)}
+
+	rw := httptest.NewRecorder()
+	serve(lb, policy, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	names := map[string]bool{}
+	for _, cookie := range rw.Result().Cookies() {
+		names[cookie.Name] = true
+	}
+	c.Check(names, DeepEquals, map[string]bool{"lb": true, "session": true})
+
+	next := httptest.NewRecorder()
+	serve(lb, policy, next, stickyRequest(rw))
+	c.Check(next.Result().Cookies(), HasLen, 1)
+}
+
+func (s *AffinitySuite) TestPools(c *C) {
+	affinity, err := NewAffinity("lb", "secret", rejectFallback, 0)
+	c.Assert(err, IsNil)
+	web := &Balancer{
+		Mutex:    new(sync.Mutex),
+		servers:  []*Server{{Addr: "web:8000", Alive: true}},
+		affinity: affinity.forPool(defaultPool),
+	}
+	db := &Balancer{
+		Mutex:    new(sync.Mutex),
+		servers:  []*Server{{Addr: "db:8000", Alive: true}},
+		affinity: affinity.forPool("db pool"),
+	}
+	c.Check(db.affinity.Cookie, Equals, "lb-db_pool")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, lb := range []*Balancer{web, db} {
+		rw := httptest.NewRecorder()
+		lb.affinity.stick(rw, httptest.NewRequest(http.MethodGet, "/", nil), lb.servers[0])
+		c.Assert(rw.Result().Cookies(), HasLen, 1)
+		req.AddCookie(rw.Result().Cookies()[0])
+	}
+	for _, lb := range []*Balancer{web, db} {
+		server, err := lb.GetServer(req)
+		c.Assert(err, IsNil)
+		c.Check(server, Equals, lb.servers[0])
+	}
+
+	// A pin copied to the cookie of another pool isn't valid there, and a
+	// pin to a backend the pool doesn't have is ignored even by reject.
+	webCookie, err := req.Cookie("lb")
+	c.Assert(err, IsNil)
+	copied := httptest.NewRequest(http.MethodGet, "/", nil)
+	copied.AddCookie(&http.Cookie{Name: db.affinity.Cookie, Value: webCookie.Value})
+	_, ok := db.affinity.pinned(copied)
+	c.Check(ok, Equals, false)
+
+	web.servers[0].Addr = "web:8001"
+	server, err := web.GetServer(req)
+	c.Assert(err, IsNil)
+	c.Check(server.Addr, Equals, "web:8001")
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"context"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"flag"
-	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -17,9 +20,59 @@ import (
 
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
+	adminPort  = flag.Int("admin-port", 8091, "load balancer admin port")
+	configPath = flag.String("config", "", "path to the JSON file with the backends configuration")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	drainTime  = flag.Duration("shutdown-timeout", 15*time.Second, "how long active requests may take to finish on shutdown")
+	strategy   = flag.String("strategy", leastConnectionsStrategy, "backend selection strategy: "+strategyNames)
+	hashKey    = flag.String("hash-key", "query:key", "request attribute used by the consistent-hash strategy: uri, query:<name>, header:<name> or cookie:<name>")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
 
+	tlsCert     = flag.String("tls-cert", "", "comma-separated certificate files, serves the frontend over TLS if set")
+	tlsKey      = flag.String("tls-key", "", "comma-separated private key files matching --tls-cert")
+	tlsReload   = flag.Duration("tls-reload-interval", 30*time.Second, "how often the certificate files are checked for changes")
+	backendCA   = flag.String("backend-ca", "", "CA bundle verifying HTTPS backends instead of the system roots")
+	backendCert = flag.String("backend-cert", "", "client certificate presented to HTTPS backends")
+	backendKey  = flag.String("backend-key", "", "private key of --backend-cert")
+
+	upstreamProtocol = flag.String("upstream-protocol", http1Protocol, "protocol spoken to the backends: http1, h2 or h2c")
+	maxIdlePerHost   = flag.Int("max-idle-per-host", 64, "idle HTTP/1.1 connections kept open to every backend, ignored by h2c, which multiplexes the requests over one connection")
+	idleTimeout      = flag.Duration("idle-timeout", 90*time.Second, "how long unused backend connections are kept open")
+
+	healthPath     = flag.String("health-path", "/health", "path of the backend health checks")
+	healthInterval = flag.Duration("health-interval", 10*time.Second, "period of the backend health checks")
+	healthTimeout  = flag.Duration("health-timeout", 3*time.Second, "timeout of a single health check")
+	healthRise     = flag.Int("health-rise", 2, "consecutive passed health checks that bring a backend up")
+	healthFall     = flag.Int("health-fall", 3, "consecutive failed health checks that bring a backend down")
+
+	slowStart = flag.Duration("slow-start", 30*time.Second, "time a recovered backend takes to ramp up to its full share of traffic")
+
+	retries    = flag.Int("retries", 2, "how many other backends an idempotent request is retried on")
+	retryRatio = flag.Float64("retry-ratio", 0.2, "maximum share of retries relative to all requests")
+
+	breakerFailures   = flag.Int("breaker-failures", 3, "consecutive forwarding failures that open a backend circuit, 0 disables passive health checks")
+	breakerBackoff    = flag.Duration("breaker-backoff", 5*time.Second, "time an open circuit waits before probing the backend")
+	breakerMaxBackoff = flag.Duration("breaker-max-backoff", time.Minute, "upper bound of the backoff doubled after every failed probe")
+	breakerProbes     = flag.Int("breaker-probes", 2, "successful probes needed to close a backend circuit")
+
+	rateLimit      = flag.Float64("rate-limit", 0, "requests per second a client may send, 0 disables rate limiting")
+	rateBurst      = flag.Int("rate-burst", 20, "requests a client may send at once before the rate limit applies")
+	rateKey        = flag.String("rate-key", "ip", "what tells the clients apart: ip, header:<name>, query:<name> or cookie:<name>, falling back to the address")
+	maxInFlight    = flag.Int("max-in-flight", 0, "requests served at once, 0 means unlimited")
+	maxConnections = flag.Int("backend-max-connections", 0, "requests forwarded to a single backend at once, 0 means unlimited")
+	queueSize      = flag.Int("queue-size", 100, "requests waiting for a backend when all are down or busy, 0 fails them at once")
+	queueTimeout   = flag.Duration("queue-timeout", 5*time.Second, "how long a request waits for a backend")
+
+	stickyCookie   = flag.String("sticky-cookie", "", "name of the cookie pinning clients to a backend, suffixed with -<pool> for the pools besides the default one, empty disables sticky sessions")
+	stickySecret   = flag.String("sticky-secret", "", "key signing the sticky cookies, a random one is used if empty")
+	stickyFallback = flag.String("sticky-fallback", rebalanceFallback, "what to do when the pinned backend is unavailable: rebalance or reject")
+	stickyMaxAge   = flag.Duration("sticky-max-age", 0, "lifetime of the sticky cookie, 0 keeps it for the browser session")
+
+	accessLogPath    = flag.String("access-log", "", "file the access log is written to, - for stdout, empty disables it")
+	accessLogFormat  = flag.String("access-log-format", jsonFormat, "format of the access log: json or logfmt")
+	accessLogSize    = flag.Int64("access-log-max-size", 100, "size in megabytes the access log file is rotated at")
+	accessLogBackups = flag.Int("access-log-backups", 5, "rotated access log files kept")
+
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
 )
 
@@ -32,49 +85,457 @@ var (
 	}
 )
 
+// retryReserve is the number of retries the budget allows in a burst.
+const retryReserve = 10
+
+var (
+	errServerExists  = errors.New("server is already registered")
+	errServerUnknown = errors.New("server is not registered")
+	errNoServer      = errors.New("no server available")
+)
+
 type Server struct {
 	Addr        string
+	Weight      int
 	Connections int
 	Alive       bool
+	Draining    bool
+	Disabled    bool
+
+	// MaxConnections caps Connections, zero leaves them unlimited.
+	MaxConnections int
+
+	// Requests counts the requests forwarded to the backend, Errors the
+	// ones it failed to answer, Timeouts included.
+	Requests int64
+	Errors   int64
+	Timeouts int64
+
+	check     HealthCheckConfig
+	health    healthState
+	transport http.RoundTripper
+	breaker   breaker
+	stop      chan struct{}
+
+	// recoveredAt is when the backend came back after a failure, it gets
+	// only a part of its traffic for the slow start window after that.
+	recoveredAt time.Time
+	// effective is the Weight scaled by the slow start. The balancer sets
+	// it before every selection, zero stands for the full Weight.
+	effective float64
+}
+
+// weight returns the share of traffic the backend takes relative to others.
+func (s *Server) weight() float64 {
+	if s.effective > 0 {
+		return s.effective
+	}
+	if s.Weight <= 0 {
+		return 1
+	}
+	return float64(s.Weight)
+}
+
+// load is the number of connections per unit of weight the backend would
+// have with one more request.
+func (s *Server) load() float64 {
+	return float64(s.Connections+1) / s.weight()
 }
 
 type Balancer struct {
 	*sync.Mutex
 	servers []*Server
+
+	// strategy selects one of the available backends. Least connections
+	// is used when it is nil.
+	strategy Strategy
+
+	breaker BreakerConfig
+
+	// health holds the default health check settings of the backends. A
+	// zero interval disables the checks, which is what the tests rely on.
+	health HealthCheckConfig
+
+	transport TransportConfig
+	tlsConfig *tls.Config
+
+	// slowStart is the time a recovered backend takes to ramp up to its
+	// full weight.
+	slowStart time.Duration
+
+	// affinity pins clients to backends, nil disables sticky sessions.
+	affinity *Affinity
+
+	// name is the pool the balancer serves.
+	name string
+
+	// maxConnections is the default connection limit of the backends and
+	// rejected counts the requests turned away as all backends were at
+	// their limits.
+	maxConnections int
+	rejected       int64
+
+	// queue bounds the requests waiting for a backend, waiters holds them
+	// in the order they came.
+	queue   QueueConfig
+	waiters []chan struct{}
+}
+
+// minSlowStart is the share of its weight a backend starts with.
+const minSlowStart = 0.05
+
+// Options tune a Balancer.
+type Options struct {
+	// Name is the pool the balancer serves, it labels the metrics.
+	Name     string
+	Strategy Strategy
+	Breaker  BreakerConfig
+	Health   HealthCheckConfig
+	// Transport holds the default connection settings and TLS configures
+	// the connections to HTTPS backends.
+	Transport TransportConfig
+	TLS       *tls.Config
+	SlowStart time.Duration
+	Affinity  *Affinity
+	// MaxConnections is the connection limit of the backends configured
+	// without one.
+	MaxConnections int
+	Queue          QueueConfig
 }
 
-func (lb *Balancer) GetServer() (*Server, error) {
+// GetServer picks a backend for r out of the available ones, skipping the
+// excluded servers. A request pinned to an available backend goes there.
+// Backends at their connection limit are not available; the limit is
+// checked before the request is forwarded, so concurrent requests may
+// exceed it briefly.
+func (lb *Balancer) GetServer(r *http.Request, exclude ...*Server) (*Server, error) {
 	lb.Lock()
 	defer lb.Unlock()
+	server, err := lb.pick(r, exclude...)
+	if err == errSaturated {
+		lb.rejected++
+	}
+	return server, err
+}
+
+// pick is GetServer called under the lock.
+func (lb *Balancer) pick(r *http.Request, exclude ...*Server) (*Server, error) {
+	now := time.Now()
+	available, err := lb.available(now, exclude...)
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range available {
+		server.effective = 0
+		if factor := lb.slowStartFactor(server, now); factor < 1 {
+			server.effective = server.weight() * factor
+		}
+	}
+	var server *Server
+	// A pin to a backend the pool no longer has is as good as none.
+	if addr, ok := lb.affinity.pinned(r); ok {
+		if i := lb.find(addr); i >= 0 && contains(available, lb.servers[i]) {
+			server = lb.servers[i]
+		} else if i >= 0 && lb.affinity.Fallback == rejectFallback {
+			return nil, errStickyServer
+		}
+	}
+	if server == nil && lb.strategy == nil {
+		server = leastConnections{}.Next(available, r)
+	} else if server == nil {
+		server = lb.strategy.Next(available, r)
+	}
+	if server.breaker.state == circuitOpen {
+		log.Printf("Probing %s, circuit half-open", server.Addr)
+	}
+	server.breaker.picked()
+	return server, nil
+}
+
+// available lists the backends that may take a request, telling why there
+// are none.
+func (lb *Balancer) available(now time.Time, exclude ...*Server) ([]*Server, error) {
 	var available []*Server
+	saturated := false
 	for _, server := range lb.servers {
-		if server.Alive {
+		if server.Alive && !server.Draining && !server.Disabled && server.breaker.allow(now) && !contains(exclude, server) {
+			if server.MaxConnections > 0 && server.Connections >= server.MaxConnections {
+				saturated = true
+				continue
+			}
 			available = append(available, server)
 		}
 	}
+	if len(available) == 0 && saturated {
+		return nil, errSaturated
+	}
 	if len(available) == 0 {
-		return nil, errors.New("no server available")
+		return nil, errNoServer
+	}
+	return available, nil
+}
+
+// slowStartFactor is the share of its weight a backend that has recovered
+// within the slow start window gets, it grows linearly with the time passed.
+func (lb *Balancer) slowStartFactor(server *Server, now time.Time) float64 {
+	elapsed := now.Sub(server.recoveredAt)
+	if lb.slowStart <= 0 || server.recoveredAt.IsZero() || elapsed >= lb.slowStart {
+		return 1
+	}
+	factor := float64(elapsed) / float64(lb.slowStart)
+	if factor < minSlowStart {
+		return minSlowStart
+	}
+	return factor
+}
+
+func (lb *Balancer) SetServers(servers []ServerConfig) {
+	for _, server := range servers {
+		_ = lb.AddServer(server)
+	}
+}
+
+// Servers returns a snapshot of the registered backends.
+func (lb *Balancer) Servers() []Server {
+	lb.Lock()
+	defer lb.Unlock()
+	res := make([]Server, len(lb.servers))
+	for i, server := range lb.servers {
+		res[i] = *server
+	}
+	return res
+}
+
+func (lb *Balancer) AddServer(config ServerConfig) error {
+	lb.Lock()
+	defer lb.Unlock()
+	if lb.find(config.Addr) >= 0 {
+		return errServerExists
+	}
+	weight := config.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	maxConnections := config.MaxConnections
+	if maxConnections == 0 {
+		maxConnections = lb.maxConnections
+	}
+	transport, err := newTransport(config.Transport.merge(lb.transport), lb.tlsConfig)
+	if err != nil {
+		return err
+	}
+	server := &Server{
+		Addr:           config.Addr,
+		Weight:         weight,
+		MaxConnections: maxConnections,
+		Alive:          true,
+		check:          config.Health.merge(lb.health),
+		transport:      transport,
+	}
+	lb.servers = append(lb.servers, server)
+	lb.watch(server)
+	lb.wake()
+	return nil
+}
+
+func (lb *Balancer) RemoveServer(addr string) error {
+	lb.Lock()
+	defer lb.Unlock()
+	i := lb.find(addr)
+	if i < 0 {
+		return errServerUnknown
+	}
+	lb.remove(i)
+	return nil
+}
+
+// DrainServer stops sending new requests to the backend and removes it
+// from the pool as soon as its last connection finishes.
+func (lb *Balancer) DrainServer(addr string) error {
+	lb.Lock()
+	defer lb.Unlock()
+	i := lb.find(addr)
+	if i < 0 {
+		return errServerUnknown
+	}
+	server := lb.servers[i]
+	server.Draining = true
+	if server.Connections == 0 {
+		lb.remove(i)
+	}
+	return nil
+}
+
+// SetEnabled takes the backend out of rotation or puts it back, keeping it
+// registered and health checked meanwhile.
+func (lb *Balancer) SetEnabled(addr string, enabled bool) error {
+	lb.Lock()
+	defer lb.Unlock()
+	i := lb.find(addr)
+	if i < 0 {
+		return errServerUnknown
+	}
+	lb.servers[i].Disabled = !enabled
+	lb.wake()
+	return nil
+}
+
+func (lb *Balancer) acquire(server *Server) {
+	lb.Lock()
+	defer lb.Unlock()
+	lb.hold(server)
+}
+
+// hold is acquire called under the lock.
+func (lb *Balancer) hold(server *Server) {
+	server.Connections++
+	server.Requests++
+}
+
+func (lb *Balancer) release(server *Server) {
+	lb.Lock()
+	defer lb.Unlock()
+	server.Connections--
+	lb.wake()
+	if server.Draining && server.Connections == 0 {
+		if i := lb.indexOf(server); i >= 0 {
+			lb.remove(i)
+		}
+	}
+}
+
+// report records the outcome of a request forwarded to server, which
+// drives its circuit breaker. Requests the client gave up on and failed
+// protocol switches count neither way.
+func (lb *Balancer) report(server *Server, err error) {
+	lb.Lock()
+	defer lb.Unlock()
+	if err == errClientGone || errors.Is(err, errUpgrade) {
+		server.breaker.abandoned()
+		return
+	}
+	state := server.breaker.state
+	if err == nil {
+		server.breaker.success(lb.breaker)
+	} else {
+		server.Errors++
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			server.Timeouts++
+		}
+		server.breaker.failure(lb.breaker, time.Now())
+	}
+	if server.breaker.state != state {
+		if server.breaker.state == circuitClosed {
+			server.recoveredAt = time.Now()
+			lb.wake()
+		}
+		if server.breaker.state == circuitOpen {
+			log.Printf("Circuit for %s opened for %s: %s", server.Addr, server.breaker.backoff, err)
+		} else {
+			log.Printf("Circuit for %s is %s", server.Addr, server.breaker.state)
+		}
 	}
-	min := available[0]
-	for _, next := range available {
-		next := next
-		if next.Connections < min.Connections {
-			min = next
+}
+
+// roundTripper returns the transport to the backend.
+func (s *Server) roundTripper() http.RoundTripper {
+	if s.transport == nil {
+		return upstream
+	}
+	return s.transport
+}
+
+func contains(servers []*Server, server *Server) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
 		}
 	}
-	return min, nil
+	return false
 }
 
-func (lb *Balancer) SetServers(serverPool []string) {
-	for _, serverAddr := range serversPool {
-		server := &Server{serverAddr, 0, true}
-		lb.servers = append(lb.servers, server)
+func (lb *Balancer) find(addr string) int {
+	for i, server := range lb.servers {
+		if server.Addr == addr {
+			return i
+		}
 	}
+	return -1
 }
 
-func NewBalancer(serverPool []string) *Balancer {
-	lb := &Balancer{new(sync.Mutex), []*Server{}}
-	lb.SetServers(serverPool)
+func (lb *Balancer) indexOf(server *Server) int {
+	for i, s := range lb.servers {
+		if s == server {
+			return i
+		}
+	}
+	return -1
+}
+
+func (lb *Balancer) remove(i int) {
+	server := lb.servers[i]
+	if server.stop != nil {
+		close(server.stop)
+	}
+	if transport, ok := server.transport.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+	servers := make([]*Server, 0, len(lb.servers)-1)
+	servers = append(servers, lb.servers[:i]...)
+	lb.servers = append(servers, lb.servers[i+1:]...)
+}
+
+func (lb *Balancer) watch(server *Server) {
+	if server.check.Interval <= 0 {
+		return
+	}
+	server.stop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Duration(server.check.Interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				lb.recordHealth(server, check(server.roundTripper(), server.Addr, server.check))
+			}
+		}
+	}(server.stop)
+}
+
+func (lb *Balancer) recordHealth(server *Server, result healthResult) {
+	lb.Lock()
+	defer lb.Unlock()
+	if !server.health.update(server, server.check, result) {
+		return
+	}
+	if server.Alive {
+		server.recoveredAt = result.At
+		lb.wake()
+		log.Printf("Backend %s is up: %d health checks passed", server.Addr, server.health.rises)
+	} else {
+		log.Printf("Backend %s is down: %d health checks failed, last one with %s", server.Addr, server.health.falls, result.Reason)
+	}
+}
+
+func NewBalancer(servers []ServerConfig, options Options) *Balancer {
+	lb := &Balancer{
+		Mutex:     new(sync.Mutex),
+		servers:   []*Server{},
+		strategy:  options.Strategy,
+		breaker:   options.Breaker,
+		health:    options.Health,
+		transport: options.Transport,
+		tlsConfig: options.TLS,
+		slowStart: options.SlowStart,
+		affinity:  options.Affinity,
+		name:      options.Name,
+
+		maxConnections: options.MaxConnections,
+		queue:          options.Queue,
+	}
+	lb.SetServers(servers)
 	return lb
 }
 
@@ -85,77 +546,199 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
+// serve forwards r to a backend picked by lb. Idempotent requests the
+// backend fails to answer are retried on other backends as the policy
+// allows.
+func serve(lb *Balancer, policy RetryPolicy, rw http.ResponseWriter, r *http.Request) {
+	body, retryable := replayable(r)
+	policy.Budget.deposit()
+	record := recordOf(r)
+
+	var tried []*Server
+	for attempt := 0; ; attempt++ {
+		var server *Server
+		var err error
+		if attempt == 0 {
+			server, err = lb.WaitServer(r.Context(), r)
+		} else if server, err = lb.GetServer(r, tried...); err == nil {
+			lb.acquire(server)
+		}
+		if err != nil {
+			unavailable(rw, r, err)
+			return
+		}
+		lb.affinity.stick(rw, r, server)
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		start := time.Now()
+		status, err := forward(server.Addr, server.roundTripper(), rw, r)
+		lb.report(server, err)
+		lb.release(server)
+		observe(lb, server, status, start)
+		record.forwarded(server, attempt, status, start)
+		if err == nil || err == errClientGone {
+			return
+		}
+		if errors.Is(err, errUpgrade) {
+			log.Printf("Failed to switch protocols with %s: %s", server.Addr, err)
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		tried = append(tried, server)
+		if !retryable || attempt >= policy.Attempts || r.Context().Err() != nil || !policy.Budget.withdraw() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Retrying %s %s after %s failed", r.Method, r.URL, server.Addr)
+		retriesMetric.Inc()
+	}
+}
+
+// unavailable tells the client why there is no backend for its request.
+func unavailable(rw http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	log.Printf("Failed to pick a backend for %s: %s", r.URL, err)
+	if errors.Is(err, errSaturated) {
+		rejectedMetric.Inc("saturated")
+		rw.Header().Set("Retry-After", "1")
 	}
-	return true
+	http.Error(rw, err.Error(), http.StatusServiceUnavailable)
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
-	fwdRequest.Header.Set("lb-author", r.RemoteAddr)
+func main() {
+	flag.Parse()
+	timeout = time.Duration(*timeoutSec) * time.Second
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
+	config := defaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %s", err)
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+	}
+	tlsConfig, err := backendTLS(*backendCA, *backendCert, *backendKey)
+	if err != nil {
+		log.Fatalf("Failed to configure backend TLS: %s", err)
+	}
+	var affinity *Affinity
+	if *stickyCookie != "" {
+		affinity, err = NewAffinity(*stickyCookie, *stickySecret, *stickyFallback, *stickyMaxAge)
+		if err != nil {
+			log.Fatalf("Invalid sticky sessions: %s", err)
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
+	}
+	pools, err := newPools(config, *strategy, *hashKey, Options{
+		Breaker: BreakerConfig{
+			Failures:   *breakerFailures,
+			Backoff:    *breakerBackoff,
+			MaxBackoff: *breakerMaxBackoff,
+			Probes:     *breakerProbes,
+		},
+		Health: config.Health.merge(HealthCheckConfig{
+			Path:     *healthPath,
+			Interval: Duration(*healthInterval),
+			Timeout:  Duration(*healthTimeout),
+			Rise:     *healthRise,
+			Fall:     *healthFall,
+			Status:   []int{http.StatusOK},
+		}),
+		Transport: config.Transport.merge(TransportConfig{
+			Protocol:       *upstreamProtocol,
+			MaxIdlePerHost: *maxIdlePerHost,
+			IdleTimeout:    Duration(*idleTimeout),
+		}),
+		TLS:       tlsConfig,
+		SlowStart: *slowStart,
+		Affinity:  affinity,
+
+		MaxConnections: *maxConnections,
+		Queue:          QueueConfig{Size: *queueSize, Timeout: *queueTimeout},
+	})
+	if err != nil {
+		log.Fatalf("Invalid pool: %s", err)
+	}
+	router, err := NewRouter(config.Routes, pools)
+	if err != nil {
+		log.Fatalf("Invalid routes: %s", err)
+	}
+
+	frontendOptions := []httptools.Option{httptools.Streaming()}
+	if *tlsCert != "" {
+		pairs, err := certPairs(*tlsCert, *tlsKey)
 		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+			log.Fatalf("Invalid TLS certificates: %s", err)
 		}
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
+		certs, err := httptools.LoadCertificates(pairs...)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificates: %s", err)
+		}
+		certs.Watch(*tlsReload, nil)
+		signal.OnHangup(func() {
+			if err := certs.Reload(); err != nil {
+				log.Printf("Failed to reload TLS certificates: %s", err)
+			}
+		})
+		frontendOptions = append(frontendOptions, httptools.TLS(certs))
 	}
-}
 
-func main() {
-	flag.Parse()
+	var limits Limits
+	if *rateLimit > 0 {
+		limits.Rate, err = NewRateLimiter(*rateLimit, *rateBurst, *rateKey)
+		if err != nil {
+			log.Fatalf("Invalid rate limit: %s", err)
+		}
+	}
+	if *maxInFlight > 0 {
+		limits.InFlight = NewInFlightLimit(*maxInFlight)
+	}
 
-	lb := NewBalancer(serversPool)
+	policy := RetryPolicy{
+		Attempts: *retries,
+		Budget:   NewRetryBudget(*retryRatio, retryReserve),
+	}
 
-	for _, server := range lb.servers {
-		server := server
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				availability := health(server.Addr)
-				log.Println(server.Addr, availability)
-				server.Alive = availability
+	var accessLog *AccessLog
+	if *accessLogPath != "" {
+		var out io.Writer = os.Stdout
+		if *accessLogPath != "-" {
+			file, err := openRotatingFile(*accessLogPath, *accessLogSize<<20, *accessLogBackups)
+			if err != nil {
+				log.Fatalf("Failed to open the access log: %s", err)
 			}
-		}()
+			defer file.Close()
+			out = file
+		}
+		accessLog, err = NewAccessLog(out, *accessLogFormat)
+		if err != nil {
+			log.Fatalf("Invalid access log: %s", err)
+		}
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		server, _ := lb.GetServer()
-		server.Connections++
-		forward(server.Addr, rw, r)
-		server.Connections--
-	}))
+	frontend := httptools.CreateServer(*port, httptools.Tracing(accessLog.Handler(limits.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		name, lb := router.Route(r)
+		if record := recordOf(r); record != nil {
+			record.Pool = name
+		}
+		serve(lb, policy, rw, r)
+	})))), frontendOptions...)
+	admin := httptools.CreateServer(*adminPort, adminHandler(router, limits))
+	exportMetrics(router)
 
 	log.Println("Starting load balancer...")
+	log.Printf("Balancing strategy: %s", *strategy)
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
+	admin.Start()
 	signal.WaitForTerminationSignal()
+	deadline := time.Now().Add(*drainTime)
+	httptools.Shutdown(*drainTime, frontend, admin)
+	if !waitTunnels(time.Until(deadline)) {
+		log.Printf("Dropping the tunnels still open after %s", *drainTime)
+	}
 }
@@ -2,8 +2,10 @@ package main
 
 import (
   "errors"
+  "net/http/httptest"
   "sync"
   "testing"
+  "time"
 
   . "gopkg.in/check.v1"
 )
@@ -87,7 +89,7 @@ func (s *BalancerSuite) TestBalancer(c *C) {
   }
 
   for _, testCase := range testCases {
-    server, err := testCase.lb.GetServer()
+    server, err := testCase.lb.GetServer(httptest.NewRequest("GET", "/", nil))
     c.Check(server, DeepEquals, testCase.server)
     if testCase.err == nil {
       c.Check(err, IsNil)
@@ -95,4 +97,65 @@ func (s *BalancerSuite) TestBalancer(c *C) {
       c.Check(err, ErrorMatches, testCase.err.Error())
     }
   }
-}
\ No newline at end of file
+}
+
+func (s *BalancerSuite) TestRegistry(c *C) {
+  lb := NewBalancer(nil, Options{Strategy: leastConnections{}})
+  c.Assert(lb.AddServer(ServerConfig{Addr: "server:8000"}), IsNil)
+  c.Assert(lb.AddServer(ServerConfig{Addr: "server:8001"}), IsNil)
+  c.Check(lb.AddServer(ServerConfig{Addr: "server:8000"}), Equals, errServerExists)
+  c.Check(lb.Servers(), HasLen, 2)
+
+  c.Assert(lb.RemoveServer("server:8000"), IsNil)
+  c.Check(lb.RemoveServer("server:8000"), Equals, errServerUnknown)
+  c.Check(lb.Servers(), HasLen, 1)
+
+  server, err := lb.GetServer(nil)
+  c.Assert(err, IsNil)
+  lb.acquire(server)
+  c.Assert(lb.DrainServer("server:8001"), IsNil)
+  _, err = lb.GetServer(nil)
+  c.Check(err, ErrorMatches, "no server available")
+  c.Check(lb.Servers(), HasLen, 1)
+
+  lb.release(server)
+  c.Check(lb.Servers(), HasLen, 0)
+}
+
+func (s *BalancerSuite) TestSlowStart(c *C) {
+  lb := NewBalancer(nil, Options{Strategy: leastConnections{}, SlowStart: time.Minute})
+  now := time.Now()
+  server := &Server{Addr: "server:8000", Weight: 4}
+  c.Check(lb.slowStartFactor(server, now), Equals, 1.0)
+
+  server.recoveredAt = now
+  c.Check(lb.slowStartFactor(server, now), Equals, minSlowStart)
+  c.Check(lb.slowStartFactor(server, now.Add(30*time.Second)), Equals, 0.5)
+  c.Check(lb.slowStartFactor(server, now.Add(time.Minute)), Equals, 1.0)
+
+  lb.slowStart = 0
+  c.Check(lb.slowStartFactor(server, now), Equals, 1.0)
+}
+
+func (s *BalancerSuite) TestSlowStartSpreadsLoad(c *C) {
+  lb := NewBalancer([]ServerConfig{
+    {Addr: "server:8000"},
+    {Addr: "server:8001"},
+  }, Options{Strategy: leastConnections{}, SlowStart: time.Hour})
+  lb.Lock()
+  for _, server := range lb.servers {
+    server.Alive = true
+  }
+  lb.servers[1].recoveredAt = time.Now()
+  lb.Unlock()
+
+  picked := map[string]int{}
+  for i := 0; i < 21; i++ {
+    server, err := lb.GetServer(nil)
+    c.Assert(err, IsNil)
+    lb.acquire(server)
+    picked[server.Addr]++
+  }
+  c.Check(picked["server:8000"], Equals, 20)
+  c.Check(picked["server:8001"], Equals, 1)
+}
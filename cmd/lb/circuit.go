@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+)
+
+// BreakerConfig controls passive health checking. A backend failing
+// Failures requests in a row is taken out of rotation for Backoff, then
+// receives one probe request at a time and rejoins the pool once Probes of
+// them succeed. Every failed probe doubles the backoff up to MaxBackoff.
+// A zero Failures disables the breaker.
+type BreakerConfig struct {
+	Failures   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Probes     int
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker tracks the outcomes of the requests forwarded to a single
+// backend. It is guarded by the balancer lock.
+type breaker struct {
+	state     circuitState
+	failures  int
+	successes int
+	backoff   time.Duration
+	retryAt   time.Time
+	probing   bool
+}
+
+// allow reports whether the backend may be given a request.
+func (b *breaker) allow(now time.Time) bool {
+	switch b.state {
+	case circuitOpen:
+		return !now.Before(b.retryAt)
+	case circuitHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// picked marks the backend as chosen for a request, which turns the
+// request into a probe unless the circuit is closed.
+func (b *breaker) picked() {
+	if b.state == circuitOpen {
+		b.state = circuitHalfOpen
+		b.successes = 0
+	}
+	if b.state == circuitHalfOpen {
+		b.probing = true
+	}
+}
+
+// abandoned ends a request whose outcome is unknown, the circuit may be
+// probed again.
+func (b *breaker) abandoned() {
+	b.probing = false
+}
+
+func (b *breaker) success(config BreakerConfig) {
+	switch b.state {
+	case circuitClosed:
+		b.failures = 0
+	case circuitHalfOpen:
+		b.probing = false
+		b.successes++
+		if b.successes >= config.Probes {
+			b.state = circuitClosed
+			b.failures = 0
+			b.backoff = 0
+		}
+	}
+}
+
+func (b *breaker) failure(config BreakerConfig, now time.Time) {
+	switch b.state {
+	case circuitClosed:
+		b.failures++
+		if config.Failures > 0 && b.failures >= config.Failures {
+			b.open(config, now)
+		}
+	case circuitHalfOpen:
+		b.probing = false
+		b.open(config, now)
+	}
+}
+
+func (b *breaker) open(config BreakerConfig, now time.Time) {
+	if b.backoff == 0 {
+		b.backoff = config.Backoff
+	} else {
+		b.backoff *= 2
+	}
+	if config.MaxBackoff > 0 && b.backoff > config.MaxBackoff {
+		b.backoff = config.MaxBackoff
+	}
+	b.state = circuitOpen
+	b.successes = 0
+	b.retryAt = now.Add(b.backoff)
+}
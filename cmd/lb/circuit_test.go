@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CircuitSuite struct{}
+
+var _ = Suite(&CircuitSuite{})
+
+func (s *CircuitSuite) TestBreaker(c *C) {
+	config := BreakerConfig{Failures: 2, Backoff: time.Second, MaxBackoff: 3 * time.Second, Probes: 2}
+	now := time.Now()
+	var b breaker
+
+	b.failure(config, now)
+	b.success(config)
+	b.failure(config, now)
+	c.Check(b.state, Equals, circuitClosed)
+	b.failure(config, now)
+	c.Assert(b.state, Equals, circuitOpen)
+	c.Check(b.allow(now), Equals, false)
+
+	now = now.Add(time.Second)
+	c.Assert(b.allow(now), Equals, true)
+	b.picked()
+	c.Check(b.state, Equals, circuitHalfOpen)
+	c.Check(b.allow(now), Equals, false)
+	b.failure(config, now)
+	c.Check(b.state, Equals, circuitOpen)
+	c.Check(b.backoff, Equals, 2*time.Second)
+
+	now = now.Add(2 * time.Second)
+	b.picked()
+	b.failure(config, now)
+	c.Check(b.backoff, Equals, 3*time.Second)
+
+	now = now.Add(3 * time.Second)
+	b.picked()
+	b.success(config)
+	c.Check(b.state, Equals, circuitHalfOpen)
+	c.Check(b.allow(now), Equals, true)
+	b.picked()
+	b.success(config)
+	c.Check(b.state, Equals, circuitClosed)
+	c.Check(b.backoff, Equals, time.Duration(0))
+}
+
+func (s *CircuitSuite) TestDisabledBreaker(c *C) {
+	var b breaker
+	for i := 0; i < 100; i++ {
+		b.failure(BreakerConfig{}, time.Now())
+	}
+	c.Check(b.state, Equals, circuitClosed)
+}
+
+func (s *CircuitSuite) TestBalancerSkipsOpenCircuit(c *C) {
+	lb := &Balancer{
+		Mutex: new(sync.Mutex),
+		servers: []*Server{
+			{Addr: "server:8000", Alive: true},
+			{Addr: "server:8001", Connections: 5, Alive: true},
+		},
+		breaker: BreakerConfig{Failures: 1, Backoff: time.Minute, Probes: 1},
+	}
+
+	server, err := lb.GetServer(nil)
+	c.Assert(err, IsNil)
+	c.Assert(server.Addr, Equals, "server:8000")
+	lb.report(server, errors.New("connection refused"))
+
+	server, err = lb.GetServer(nil)
+	c.Assert(err, IsNil)
+	c.Check(server.Addr, Equals, "server:8001")
+}
+
+func (s *CircuitSuite) TestClientGone(c *C) {
+	blocked := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer backend.Close()
+	defer close(blocked)
+	lb := &Balancer{
+		Mutex:   new(sync.Mutex),
+		servers: []*Server{{Addr: strings.TrimPrefix(backend.URL, "http://"), Alive: true}},
+		breaker: BreakerConfig{Failures: 2, Backoff: time.Minute, Probes: 1},
+	}
+	server := lb.servers[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	_, err := forward(server.Addr, upstream, httptest.NewRecorder(), req)
+	c.Assert(err, Equals, errClientGone)
+
+	lb.report(server, errors.New("connection refused"))
+	lb.report(server, errClientGone)
+	c.Check(server.breaker.failures, Equals, 1)
+	c.Check(server.Errors, Equals, int64(1))
+
+	server.breaker.open(lb.breaker, time.Now().Add(-time.Hour))
+	server.breaker.picked()
+	lb.report(server, errClientGone)
+	c.Check(server.breaker.state, Equals, circuitHalfOpen)
+	c.Check(server.breaker.allow(time.Now()), Equals, true)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config describes the backends the balancer starts with. It is read
+// from a JSON file passed with the --config flag, e.g.
+//
+//	{
+//	  "health": {"path": "/health", "interval": "5s", "rise": 2, "fall": 3},
+//	  "transport": {"protocol": "h2c", "idleTimeout": "30s"},
+//	  "servers": [
+//	    {"addr": "server1:8080", "weight": 2, "transport": {"protocol": "http1"}},
+//	    {"addr": "server2:8080", "health": {"status": [200, 204], "body": "OK"}}
+//	  ],
+//	  "pools": {
+//	    "db": {
+//	      "strategy": "consistent-hash",
+//	      "hashKey": "uri",
+//	      "health": {"path": "/health"},
+//	      "servers": [{"addr": "db:18080"}]
+//	    }
+//	  },
+//	  "routes": [
+//	    {"prefix": "/db/", "pool": "db"},
+//	    {"host": "admin.example.com", "method": "GET", "header": {"X-Debug": ""}, "pool": "db"}
+//	  ]
+//	}
+//
+// A missing or zero weight counts as 1. Health check and transport
+// settings of a server override those of its pool, which override the
+// top-level ones, which override the command line flags. The top-level
+// servers make up the default pool, serving the requests no route matches.
+type Config struct {
+	Health    HealthCheckConfig     `json:"health"`
+	Transport TransportConfig       `json:"transport"`
+	Servers   []ServerConfig        `json:"servers"`
+	Pools     map[string]PoolConfig `json:"pools"`
+	Routes    []Route               `json:"routes"`
+}
+
+// PoolConfig describes a named pool of backends balanced separately. An
+// empty strategy or hash key means the one given on the command line.
+type PoolConfig struct {
+	Strategy  string            `json:"strategy,omitempty"`
+	HashKey   string            `json:"hashKey,omitempty"`
+	Health    HealthCheckConfig `json:"health"`
+	Transport TransportConfig   `json:"transport"`
+	Servers   []ServerConfig    `json:"servers"`
+}
+
+type ServerConfig struct {
+	Addr      string            `json:"addr"`
+	Weight    int               `json:"weight,omitempty"`
+	Health    HealthCheckConfig `json:"health"`
+	Transport TransportConfig   `json:"transport"`
+	// MaxConnections overrides the --backend-max-connections flag.
+	MaxConnections int `json:"maxConnections,omitempty"`
+}
+
+// Duration is a time.Duration written as "1.5s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return &config, nil
+}
+
+func (config *Config) validate() error {
+	for i, server := range config.Servers {
+		if server.Addr == "" {
+			return fmt.Errorf("server %d has no address", i)
+		}
+	}
+	for name, pool := range config.Pools {
+		if name == defaultPool {
+			return fmt.Errorf("pool %q is made of the top-level servers", name)
+		}
+		for i, server := range pool.Servers {
+			if server.Addr == "" {
+				return fmt.Errorf("server %d of pool %q has no address", i, name)
+			}
+		}
+	}
+	for i, route := range config.Routes {
+		if _, ok := config.Pools[route.Pool]; !ok && route.Pool != defaultPool {
+			return fmt.Errorf("route %d leads to unknown pool %q", i, route.Pool)
+		}
+	}
+	return nil
+}
+
+// defaultConfig is used when no configuration file is given.
+func defaultConfig() *Config {
+	config := &Config{}
+	for _, addr := range serversPool {
+		config.Servers = append(config.Servers, ServerConfig{Addr: addr})
+	}
+	return config
+}
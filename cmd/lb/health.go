@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHealthBody limits how much of a health check response is searched
+// for the expected body.
+const maxHealthBody = 64 << 10
+
+// HealthCheckConfig describes the active health checks of a backend. Zero
+// fields are inherited from the balancer defaults, see merge.
+type HealthCheckConfig struct {
+	Path     string   `json:"path,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	// Rise and Fall are the numbers of consecutive passed and failed checks
+	// that bring a backend up and down.
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+	// Status lists the response codes counted as healthy.
+	Status []int `json:"status,omitempty"`
+	// Body, if set, must be contained in the response body.
+	Body string `json:"body,omitempty"`
+}
+
+// merge returns c with its zero fields taken from defaults.
+func (c HealthCheckConfig) merge(defaults HealthCheckConfig) HealthCheckConfig {
+	if c.Path == "" {
+		c.Path = defaults.Path
+	}
+	if c.Interval == 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.Rise == 0 {
+		c.Rise = defaults.Rise
+	}
+	if c.Fall == 0 {
+		c.Fall = defaults.Fall
+	}
+	if len(c.Status) == 0 {
+		c.Status = defaults.Status
+	}
+	if c.Body == "" {
+		c.Body = defaults.Body
+	}
+	return c
+}
+
+func (c HealthCheckConfig) expects(status int) bool {
+	if len(c.Status) == 0 {
+		return status == http.StatusOK
+	}
+	for _, s := range c.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type healthResult struct {
+	At      time.Time
+	Latency time.Duration
+	OK      bool
+	// Reason explains a failed check.
+	Reason string
+}
+
+// healthState follows the checks of a backend. It is guarded by the
+// balancer lock.
+type healthState struct {
+	rises, falls int
+	last         healthResult
+}
+
+// update records result and reports whether the backend changed its state.
+func (s *healthState) update(server *Server, config HealthCheckConfig, result healthResult) bool {
+	s.last = result
+	if result.OK {
+		s.rises++
+		s.falls = 0
+		if !server.Alive && s.rises >= config.Rise {
+			server.Alive = true
+			return true
+		}
+	} else {
+		s.falls++
+		s.rises = 0
+		if server.Alive && s.falls >= config.Fall {
+			server.Alive = false
+			return true
+		}
+	}
+	return false
+}
+
+func check(transport http.RoundTripper, addr string, config HealthCheckConfig) healthResult {
+	result := healthResult{At: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s%s", scheme(), addr, config.Path), nil)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	resp, err := transport.RoundTrip(req)
+	result.Latency = time.Since(result.At)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	if !config.expects(resp.StatusCode) {
+		result.Reason = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		return result
+	}
+	if config.Body != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		if err != nil {
+			result.Reason = fmt.Sprintf("reading body: %s", err)
+			return result
+		}
+		if !strings.Contains(string(body), config.Body) {
+			result.Reason = fmt.Sprintf("body does not contain %q", config.Body)
+			return result
+		}
+	}
+	result.OK = true
+	return result
+}
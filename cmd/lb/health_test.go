@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type HealthSuite struct{}
+
+var _ = Suite(&HealthSuite{})
+
+func (s *HealthSuite) TestCheck(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			_, _ = rw.Write([]byte("OK"))
+		case "/ready":
+			rw.WriteHeader(http.StatusNoContent)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+
+	testCases := []struct {
+		config HealthCheckConfig
+		ok     bool
+		reason string
+	}{
+		{HealthCheckConfig{Path: "/health"}, true, ""},
+		{HealthCheckConfig{Path: "/health", Body: "OK"}, true, ""},
+		{HealthCheckConfig{Path: "/health", Body: "READY"}, false, `body does not contain "READY"`},
+		{HealthCheckConfig{Path: "/ready"}, false, "unexpected status 204"},
+		{HealthCheckConfig{Path: "/ready", Status: []int{200, 204}}, true, ""},
+		{HealthCheckConfig{Path: "/broken"}, false, "unexpected status 500"},
+		{HealthCheckConfig{Path: "/slow", Timeout: Duration(10 * time.Millisecond)}, false, ".*deadline exceeded.*"},
+	}
+	for _, testCase := range testCases {
+		if testCase.config.Timeout == 0 {
+			testCase.config.Timeout = Duration(time.Second)
+		}
+		result := check(upstream, addr, testCase.config)
+		c.Check(result.OK, Equals, testCase.ok, Commentf(testCase.config.Path))
+		c.Check(result.Reason, Matches, testCase.reason, Commentf(testCase.config.Path))
+	}
+}
+
+func (s *HealthSuite) TestRiseFall(c *C) {
+	config := HealthCheckConfig{Rise: 2, Fall: 3}
+	server := &Server{Addr: "server:8000", Alive: true}
+	var state healthState
+	passed := healthResult{OK: true}
+	failed := healthResult{Reason: "connection refused"}
+
+	c.Check(state.update(server, config, failed), Equals, false)
+	c.Check(state.update(server, config, failed), Equals, false)
+	c.Check(state.update(server, config, passed), Equals, false)
+	c.Check(state.update(server, config, failed), Equals, false)
+	c.Check(state.update(server, config, failed), Equals, false)
+	c.Check(state.update(server, config, failed), Equals, true)
+	c.Check(server.Alive, Equals, false)
+	c.Check(state.last.Reason, Equals, "connection refused")
+
+	c.Check(state.update(server, config, passed), Equals, false)
+	c.Check(state.update(server, config, passed), Equals, true)
+	c.Check(server.Alive, Equals, true)
+}
+
+func (s *HealthSuite) TestMerge(c *C) {
+	defaults := HealthCheckConfig{
+		Path:     "/health",
+		Interval: Duration(10 * time.Second),
+		Timeout:  Duration(3 * time.Second),
+		Rise:     2,
+		Fall:     3,
+		Status:   []int{200},
+	}
+	merged := HealthCheckConfig{Path: "/ready", Fall: 1}.merge(defaults)
+	c.Check(merged, DeepEquals, HealthCheckConfig{
+		Path:     "/ready",
+		Interval: Duration(10 * time.Second),
+		Timeout:  Duration(3 * time.Second),
+		Rise:     2,
+		Fall:     1,
+		Status:   []int{200},
+	})
+}
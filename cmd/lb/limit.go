@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errSaturated = errors.New("all backends are at their connection limit")
+
+// minBucketSweep is the number of clients tracked before the rate limiter
+// first forgets the ones that have been idle long enough to refill.
+const minBucketSweep = 1024
+
+// Limits is the admission control in front of the pools. A nil limiter is
+// disabled.
+type Limits struct {
+	Rate     *RateLimiter
+	InFlight *InFlightLimit
+}
+
+// Handler rejects the requests over the limits with 429 Too Many Requests
+// or 503 Service Unavailable and a Retry-After header.
+func (limits Limits) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if ok, wait := limits.Rate.allow(r, time.Now()); !ok {
+			rejectedMetric.Inc("rate")
+			reject(rw, http.StatusTooManyRequests, wait)
+			return
+		}
+		if !limits.InFlight.acquire() {
+			rejectedMetric.Inc("in-flight")
+			reject(rw, http.StatusServiceUnavailable, time.Second)
+			return
+		}
+		defer limits.InFlight.release()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// reject answers with status, asking the client to come back after wait,
+// rounded up to whole seconds.
+func reject(rw http.ResponseWriter, status int, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	rw.WriteHeader(status)
+}
+
+// RateLimiter gives every client a token bucket refilled at Rate tokens per
+// second up to Burst, a request takes one token. Clients are told apart by
+// a request attribute, or by their address if the request lacks it.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	spec    string
+	key     requestKey
+	buckets map[string]*bucket
+	sweepAt int
+
+	rejected int64
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// NewRateLimiter keys the buckets by spec, which is "ip" or any of the
+// request keys of the consistent-hash strategy, e.g. "header:X-API-Key".
+func NewRateLimiter(rate float64, burst int, spec string) (*RateLimiter, error) {
+	var key requestKey
+	if spec != "ip" {
+		var err error
+		if key, err = parseHashKey(spec); err != nil {
+			return nil, err
+		}
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		spec:    spec,
+		key:     key,
+		buckets: map[string]*bucket{},
+		sweepAt: minBucketSweep,
+	}, nil
+}
+
+// allow takes a token of the client of r, if there is none it returns when
+// the next one will be available.
+func (l *RateLimiter) allow(r *http.Request, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	client := l.client(r)
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= l.sweepAt {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens < 1 {
+		l.rejected++
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *RateLimiter) client(r *http.Request) string {
+	if l.key != nil {
+		if key, ok := l.key(r); ok {
+			return key
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// sweep forgets the clients whose buckets are full again, they are the
+// same as new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.sweepAt = 2 * len(l.buckets)
+	if l.sweepAt < minBucketSweep {
+		l.sweepAt = minBucketSweep
+	}
+}
+
+// InFlightLimit caps the number of requests served at once.
+type InFlightLimit struct {
+	sync.Mutex
+	max     int
+	current int
+
+	rejected int64
+}
+
+func NewInFlightLimit(max int) *InFlightLimit {
+	return &InFlightLimit{max: max}
+}
+
+func (l *InFlightLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.current >= l.max {
+		l.rejected++
+		return false
+	}
+	l.current++
+	return true
+}
+
+func (l *InFlightLimit) release() {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.current--
+}
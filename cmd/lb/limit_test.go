@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type LimitSuite struct{}
+
+var _ = Suite(&LimitSuite{})
+
+func (s *LimitSuite) TestRateLimiter(c *C) {
+	limiter, err := NewRateLimiter(2, 3, "header:X-API-Key")
+	c.Assert(err, IsNil)
+	now := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	keyed := httptest.NewRequest(http.MethodGet, "/", nil)
+	keyed.RemoteAddr = "10.0.0.1:5001"
+	keyed.Header.Set("X-API-Key", "secret")
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow(req, now)
+		c.Check(ok, Equals, true)
+	}
+	ok, wait := limiter.allow(req, now)
+	c.Check(ok, Equals, false)
+	c.Check(wait, Equals, 500*time.Millisecond)
+
+	ok, _ = limiter.allow(keyed, now)
+	c.Check(ok, Equals, true, Commentf("the API key has a bucket of its own"))
+
+	ok, _ = limiter.allow(req, now.Add(500*time.Millisecond))
+	c.Check(ok, Equals, true)
+	ok, _ = limiter.allow(req, now.Add(500*time.Millisecond))
+	c.Check(ok, Equals, false)
+	c.Check(limiter.rejected, Equals, int64(2))
+	c.Check(limiter.buckets, HasLen, 2)
+
+	limiter.sweep(now.Add(time.Hour))
+	c.Check(limiter.buckets, HasLen, 0)
+
+	_, err = NewRateLimiter(1, 1, "body:key")
+	c.Check(err, NotNil)
+}
+
+func (s *LimitSuite) TestHandler(c *C) {
+	rate, err := NewRateLimiter(1, 1, "ip")
+	c.Assert(err, IsNil)
+	limits := Limits{Rate: rate, InFlight: NewInFlightLimit(1)}
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	h := limits.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+
+	first := httptest.NewRequest(http.MethodGet, "/", nil)
+	first.RemoteAddr = "10.0.0.1:5000"
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), first)
+	}()
+	<-entered
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, first)
+	c.Check(rw.Code, Equals, http.StatusTooManyRequests)
+	c.Check(rw.Header().Get("Retry-After"), Equals, "1")
+
+	other := httptest.NewRequest(http.MethodGet, "/", nil)
+	other.RemoteAddr = "10.0.0.2:5000"
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, other)
+	c.Check(rw.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(rw.Header().Get("Retry-After"), Equals, "1")
+
+	close(release)
+	wg.Wait()
+	c.Check(limits.InFlight.current, Equals, 0)
+	c.Check(limits.InFlight.rejected, Equals, int64(1))
+}
+
+func (s *LimitSuite) TestMaxConnections(c *C) {
+	lb := NewBalancer([]ServerConfig{
+		{Addr: "server:8000", MaxConnections: 1},
+		{Addr: "server:8001"},
+	}, Options{Strategy: leastConnections{}, MaxConnections: 2})
+	servers := lb.Servers()
+	c.Check(servers[0].MaxConnections, Equals, 1)
+	c.Check(servers[1].MaxConnections, Equals, 2)
+
+	var picked []string
+	for i := 0; i < 3; i++ {
+		server, err := lb.GetServer(nil)
+		c.Assert(err, IsNil)
+		lb.acquire(server)
+		picked = append(picked, server.Addr)
+	}
+	c.Check(picked, DeepEquals, []string{"server:8000", "server:8001", "server:8001"})
+
+	_, err := lb.GetServer(nil)
+	c.Check(err, Equals, errSaturated)
+
+	rw := httptest.NewRecorder()
+	serve(lb, RetryPolicy{Budget: NewRetryBudget(0, 0)}, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Check(rw.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(rw.Header().Get("Retry-After"), Equals, "1")
+
+	router, err := NewRouter(nil, map[string]*Balancer{defaultPool: lb})
+	c.Assert(err, IsNil)
+	rate, err := NewRateLimiter(5, 10, "ip")
+	c.Assert(err, IsNil)
+	rw = httptest.NewRecorder()
+	adminHandler(router, Limits{Rate: rate}).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	var status limitsStatus
+	c.Assert(json.NewDecoder(rw.Body).Decode(&status), IsNil)
+	c.Assert(status.Rate, NotNil)
+	c.Check(*status.Rate, Equals, rateStatus{Rate: 5, Burst: 10, Key: "ip"})
+	c.Check(status.InFlight, IsNil)
+	c.Check(status.Pools, DeepEquals, map[string]poolLimits{defaultPool: {Rejected: 2}})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gogaeva/balancer/httptools"
+)
+
+var (
+	requestsMetric = httptools.DefaultRegistry.Counter("lb_requests_total",
+		"Requests forwarded to the backends by response status, error if there was none.", "pool", "backend", "code")
+	latencyMetric = httptools.DefaultRegistry.Histogram("lb_request_duration_seconds",
+		"Time spent forwarding requests to the backends.", httptools.DefaultBuckets, "pool", "backend", "code")
+	retriesMetric = httptools.DefaultRegistry.Counter("lb_retries_total",
+		"Requests retried on another backend.")
+	rejectedMetric = httptools.DefaultRegistry.Counter("lb_rejected_total",
+		"Requests turned away by the rate limit, the in-flight limit, or as all backends were saturated.", "reason")
+	connectionsMetric = httptools.DefaultRegistry.Gauge("lb_backend_connections",
+		"Requests being forwarded to the backend.", "pool", "backend")
+	healthyMetric = httptools.DefaultRegistry.Gauge("lb_backend_healthy",
+		"Whether the backend passes its health checks.", "pool", "backend")
+	circuitMetric = httptools.DefaultRegistry.Gauge("lb_backend_circuit_open",
+		"Whether the backend circuit is open or half-open.", "pool", "backend")
+	queueMetric = httptools.DefaultRegistry.Gauge("lb_queued_requests",
+		"Requests waiting for a backend of the pool.", "pool")
+)
+
+func observe(lb *Balancer, server *Server, status int, start time.Time) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	requestsMetric.Inc(lb.name, server.Addr, code)
+	latencyMetric.ObserveSince(start, lb.name, server.Addr, code)
+}
+
+// exportMetrics mirrors the backend state of every pool in the gauges on
+// every scrape.
+func exportMetrics(router *Router) {
+	httptools.DefaultRegistry.OnScrape(func() {
+		connectionsMetric.Reset()
+		healthyMetric.Reset()
+		circuitMetric.Reset()
+		queueMetric.Reset()
+		for _, name := range router.Pools() {
+			lb := router.Pool(name)
+			lb.Lock()
+			queueMetric.Set(float64(len(lb.waiters)), name)
+			lb.Unlock()
+			for _, server := range router.Pool(name).Servers() {
+				connectionsMetric.Set(float64(server.Connections), name, server.Addr)
+				healthyMetric.Set(boolValue(server.Alive), name, server.Addr)
+				circuitMetric.Set(boolValue(server.breaker.state != circuitClosed), name, server.Addr)
+			}
+		}
+	})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogaeva/balancer/httptools"
+)
+
+// upstream sends the requests to backends without a transport of their
+// own. Unlike http.Client, a transport hands redirects back to the client
+// instead of following them.
+var upstream http.RoundTripper = http.DefaultTransport
+
+// hopHeaders are meaningful only for a single connection and must not be
+// passed on by proxies, see RFC 7230, section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const copyBufferSize = 32 << 10
+
+// timeoutError is returned when a backend does not send the response
+// headers in time. It is a net.Error, so it is counted as a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// errClientGone is returned by forward when the client goes away before
+// the backend responds, which says nothing about the backend.
+var errClientGone = errors.New("client went away")
+
+// errUpgrade is wrapped by the errors of a protocol switch the backend
+// answered but that can't be completed, which is no sign of a failing
+// backend either.
+var errUpgrade = errors.New("protocol switch failed")
+
+// tunnels counts the open protocol switch tunnels. Their connections are
+// hijacked, so the server shutdown doesn't wait for them.
+var tunnels sync.WaitGroup
+
+// waitTunnels waits for the open tunnels to close until timeout and tells
+// whether they did.
+func waitTunnels(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		tunnels.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// forward proxies r to dst and returns the backend response status. The
+// returned error tells whether the backend failed to respond, the client
+// went away or the protocol switch failed, in which case nothing is written
+// to rw; errors writing the response back are only logged.
+//
+// The timeout limits the wait for the response headers only, so streamed
+// responses may last as long as the backend keeps sending them.
+func forward(dst string, transport http.RoundTripper, rw http.ResponseWriter, r *http.Request) (int, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.AfterFunc(timeout, cancel)
+
+	fwdRequest := r.Clone(ctx)
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Scheme = scheme()
+	fwdRequest.Host = dst
+	if r.ContentLength == 0 {
+		fwdRequest.Body = nil
+	}
+	removeHopHeaders(fwdRequest.Header)
+	upgrade := upgradeType(r.Header)
+	if upgrade != "" {
+		fwdRequest.Header.Set("Connection", "Upgrade")
+		fwdRequest.Header.Set("Upgrade", upgrade)
+	}
+	if strings.Contains(strings.ToLower(r.Header.Get("Te")), "trailers") {
+		fwdRequest.Header.Set("Te", "trailers")
+	}
+	setForwardedHeaders(fwdRequest.Header, r)
+	fwdRequest.Header.Set("lb-author", r.RemoteAddr)
+
+	resp, err := transport.RoundTrip(fwdRequest)
+	if !timer.Stop() && err != nil {
+		err = timeoutError{}
+	}
+	if err != nil {
+		log.Printf("Failed to get response from %s: %s", dst, err)
+		if r.Context().Err() != nil {
+			return 0, errClientGone
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp.StatusCode, tunnel(dst, rw, resp, upgrade)
+	}
+
+	removeHopHeaders(resp.Header)
+	dropRequestID(rw.Header(), resp.Header)
+	copyHeader(rw.Header(), resp.Header)
+	announced := len(resp.Trailer)
+	if announced > 0 {
+		keys := make([]string, 0, announced)
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		rw.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+	}
+	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+	rw.WriteHeader(resp.StatusCode)
+
+	if err := copyBody(rw, resp.Body, streaming(resp)); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return resp.StatusCode, nil
+	}
+
+	// The trailers are known once the body is read to the end. The ones
+	// not announced beforehand need the http.TrailerPrefix.
+	if len(resp.Trailer) > 0 {
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	if len(resp.Trailer) == announced {
+		copyHeader(rw.Header(), resp.Trailer)
+	} else {
+		for k, values := range resp.Trailer {
+			for _, value := range values {
+				rw.Header().Add(http.TrailerPrefix+k, value)
+			}
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// tunnel completes a protocol switch, such as a WebSocket handshake, and
+// then copies the data between the client and the backend until either of
+// them closes the connection. An error means the switch failed and nothing
+// was written to rw.
+func tunnel(dst string, rw http.ResponseWriter, resp *http.Response, upgrade string) error {
+	respUpgrade := upgradeType(resp.Header)
+	if !strings.EqualFold(respUpgrade, upgrade) {
+		return fmt.Errorf("%w: backend switched to protocol %q when %q was requested", errUpgrade, respUpgrade, upgrade)
+	}
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return fmt.Errorf("%w: backend switched protocols over a read-only body", errUpgrade)
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("%w: client connection can't switch protocols", errUpgrade)
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUpgrade, err)
+	}
+	tunnels.Add(1)
+	defer tunnels.Done()
+	defer conn.Close()
+	// The tunnel lasts as long as the parties want it, drop any deadlines
+	// the frontend server had set.
+	_ = conn.SetDeadline(time.Time{})
+
+	// The response skips rw, keep the headers the lb has put there, such
+	// as the sticky cookie.
+	removeHopHeaders(resp.Header)
+	dropRequestID(rw.Header(), resp.Header)
+	copyHeader(resp.Header, rw.Header())
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", respUpgrade)
+	if *traceEnabled {
+		resp.Header.Set("lb-from", dst)
+	}
+	log.Println("fwd", resp.StatusCode, resp.Request.URL, "upgrade", respUpgrade)
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return nil
+	}
+	if err := brw.Flush(); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return nil
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backConn, brw)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backConn)
+		errc <- err
+	}()
+	if err := <-errc; err != nil {
+		log.Printf("Tunnel to %s closed: %s", dst, err)
+	}
+	_ = backConn.Close()
+	return nil
+}
+
+// upgradeType returns the protocol requested with "Connection: Upgrade".
+func upgradeType(header http.Header) string {
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// dropRequestID removes the request ID the backend returned if the lb
+// returns one already, which is the same, so that the client gets it once.
+func dropRequestID(lbHeader, header http.Header) {
+	if lbHeader.Get(httptools.RequestIDHeader) != "" {
+		header.Del(httptools.RequestIDHeader)
+	}
+}
+
+func setForwardedHeaders(header http.Header, r *http.Request) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", r.Host)
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, values := range src {
+		for _, value := range values {
+			dst.Add(k, value)
+		}
+	}
+}
+
+// streaming reports whether the response has to reach the client as soon
+// as the backend sends any of it.
+func streaming(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "text/event-stream")
+}
+
+func copyBody(rw http.ResponseWriter, body io.Reader, flush bool) error {
+	flusher, ok := rw.(http.Flusher)
+	if !flush || !ok {
+		_, err := io.Copy(rw, body)
+		return err
+	}
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
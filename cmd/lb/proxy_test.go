@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogaeva/balancer/httptools"
+	. "gopkg.in/check.v1"
+)
+
+type ProxySuite struct{}
+
+var _ = Suite(&ProxySuite{})
+
+func proxyTo(backend *httptest.Server) *httptest.Server {
+	dst := strings.TrimPrefix(backend.URL, "http://")
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if _, err := forward(dst, upstream, rw, r); err != nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func (s *ProxySuite) TestHeaders(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Hop"), Equals, "")
+		c.Check(r.Header.Get("Proxy-Authorization"), Equals, "")
+		c.Check(r.Header.Get("X-Kept"), Equals, "yes")
+		c.Check(r.Header.Get("X-Forwarded-For"), Equals, "10.0.0.1, 127.0.0.1")
+		c.Check(r.Header.Get("X-Forwarded-Proto"), Equals, "http")
+		c.Check(r.Header.Get("X-Forwarded-Host"), Equals, "example.com")
+		rw.Header().Set("Connection", "X-Secret")
+		rw.Header().Set("X-Secret", "hop")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("Location", "/elsewhere")
+		rw.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+	frontend := proxyTo(backend)
+	defer frontend.Close()
+
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Host = "example.com"
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Kept", "yes")
+	req.Header.Set("Proxy-Authorization", "secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := upstream.RoundTrip(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusFound)
+	c.Check(resp.Header.Get("Location"), Equals, "/elsewhere")
+	c.Check(resp.Header.Get("X-Secret"), Equals, "")
+	c.Check(resp.Header.Get("Keep-Alive"), Equals, "")
+}
+
+func (s *ProxySuite) TestRequestID(c *C) {
+	backend := httptest.NewServer(httptools.Tracing(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})))
+	defer backend.Close()
+	dst := strings.TrimPrefix(backend.URL, "http://")
+	frontend := httptest.NewServer(httptools.Tracing(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, err := forward(dst, upstream, rw, r)
+		c.Check(err, IsNil)
+	})))
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.Header.Values(httptools.RequestIDHeader), HasLen, 1)
+}
+
+func (s *ProxySuite) TestTrailers(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "42")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "yes")
+	}))
+	defer backend.Close()
+	frontend := proxyTo(backend)
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(string(body), Equals, "body")
+	c.Check(resp.Trailer.Get("X-Checksum"), Equals, "42")
+	c.Check(resp.Trailer.Get("X-Late"), Equals, "yes")
+}
+
+func (s *ProxySuite) TestStreaming(c *C) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		_, _ = rw.Write([]byte("data: second\n\n"))
+	}))
+	defer backend.Close()
+	frontend := proxyTo(backend)
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	line, err := events.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(line, Equals, "data: first\n")
+
+	close(release)
+	rest, err := ioutil.ReadAll(events)
+	c.Assert(err, IsNil)
+	c.Check(string(rest), Equals, "\ndata: second\n\n")
+}
+
+func (s *ProxySuite) TestUpgrade(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Connection"), Equals, "Upgrade")
+		c.Check(r.Header.Get("Upgrade"), Equals, "echo")
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Request-Id: backend\r\n\r\n")
+		_ = brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = brw.WriteString(line)
+			_ = brw.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	affinity, err := NewAffinity("lb", "secret", rebalanceFallback, 0)
+	c.Assert(err, IsNil)
+	lb := &Balancer{
+		Mutex:    new(sync.Mutex),
+		servers:  []*Server{{Addr: strings.TrimPrefix(backend.URL, "http://"), Alive: true}},
+		affinity: affinity,
+	}
+	frontend := httptest.NewServer(httptools.Tracing(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		serve(lb, RetryPolicy{Budget: NewRetryBudget(0, 0)}, rw, r)
+	})))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: lb\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	c.Assert(err, IsNil)
+
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, nil)
+	c.Assert(err, IsNil)
+	c.Check(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Check(resp.Header.Get("Upgrade"), Equals, "echo")
+	c.Check(resp.Header.Values(httptools.RequestIDHeader), HasLen, 1)
+	c.Check(resp.Header.Get(httptools.RequestIDHeader), Not(Equals), "backend")
+	cookies := resp.Cookies()
+	c.Assert(cookies, HasLen, 1)
+	c.Check(cookies[0].Name, Equals, "lb")
+
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		_, err = conn.Write([]byte(msg))
+		c.Assert(err, IsNil)
+		line, err := in.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Check(line, Equals, msg)
+	}
+	c.Check(lb.Servers()[0].Connections, Equals, 1)
+	c.Check(waitTunnels(10*time.Millisecond), Equals, false)
+
+	conn.Close()
+	c.Check(waitTunnels(time.Second), Equals, true)
+	for i := 0; i < 100 && lb.Servers()[0].Connections != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(lb.Servers()[0].Connections, Equals, 0)
+}
+
+func (s *ProxySuite) TestUpgradeMismatch(c *C) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: other\r\n\r\n")
+		_ = brw.Flush()
+	}))
+	defer backend.Close()
+
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	lb := &Balancer{
+		Mutex:   new(sync.Mutex),
+		servers: []*Server{{Addr: addr, Alive: true}, {Addr: addr, Alive: true}},
+		breaker: BreakerConfig{Failures: 1, Backoff: time.Minute, Probes: 1},
+	}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	serve(lb, RetryPolicy{Attempts: 1, Budget: NewRetryBudget(1, 10)}, rw, req)
+
+	c.Check(rw.Code, Equals, http.StatusBadGateway)
+	c.Check(atomic.LoadInt32(&hits), Equals, int32(1))
+	for _, server := range lb.Servers() {
+		c.Check(server.Errors, Equals, int64(0))
+		c.Check(server.breaker.state, Equals, circuitClosed)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// queuePoll is how often waiting requests look for a backend on their own.
+// Most of the time they are woken up as soon as one becomes available, but
+// nothing tells them when the backoff of an open circuit ends.
+const queuePoll = 250 * time.Millisecond
+
+// QueueConfig lets up to Size requests wait Timeout for a backend when all
+// of them are down or at their connection limits. A zero Size disables the
+// queue.
+type QueueConfig struct {
+	Size    int
+	Timeout time.Duration
+}
+
+// waitable tells whether a backend may become available for a request
+// GetServer failed with err.
+func waitable(err error) bool {
+	return err == errNoServer || err == errSaturated
+}
+
+// WaitServer is GetServer that queues the request when no backend is
+// available. Requests are served in the order they came, each one waits
+// until the deadline of the queue or until ctx is done. The backend is
+// acquired before the next request gets its turn, so the caller only has
+// to release it.
+func (lb *Balancer) WaitServer(ctx context.Context, r *http.Request, exclude ...*Server) (*Server, error) {
+	lb.Lock()
+	var err error
+	if len(lb.waiters) == 0 {
+		var server *Server
+		if server, err = lb.pick(r, exclude...); err == nil {
+			lb.hold(server)
+		}
+		if !waitable(err) || lb.queue.Size <= 0 {
+			lb.countRejected(err)
+			lb.Unlock()
+			return server, err
+		}
+	} else if _, err = lb.available(time.Now(), exclude...); err == nil {
+		// A backend has just become available, but the requests queued
+		// before this one come first.
+		err = errNoServer
+	}
+	if len(lb.waiters) >= lb.queue.Size {
+		lb.countRejected(err)
+		lb.Unlock()
+		return nil, fmt.Errorf("%w, wait queue is full", err)
+	}
+	ready := make(chan struct{}, 1)
+	lb.waiters = append(lb.waiters, ready)
+	lb.Unlock()
+
+	deadline := time.NewTimer(lb.queue.Timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(queuePoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ready:
+		case <-poll.C:
+		case <-deadline.C:
+			lb.Lock()
+			lb.leave(ready)
+			lb.countRejected(err)
+			lb.Unlock()
+			return nil, fmt.Errorf("%w after waiting %s in the queue", err, lb.queue.Timeout)
+		case <-ctx.Done():
+			lb.Lock()
+			lb.leave(ready)
+			lb.Unlock()
+			return nil, ctx.Err()
+		}
+
+		lb.Lock()
+		if lb.waiters[0] == ready {
+			var server *Server
+			server, err = lb.pick(r, exclude...)
+			if err == nil {
+				lb.hold(server)
+			}
+			if !waitable(err) {
+				lb.leave(ready)
+				lb.Unlock()
+				return server, err
+			}
+		}
+		lb.Unlock()
+	}
+}
+
+// leave removes a waiter from the queue, letting the next one try its luck.
+func (lb *Balancer) leave(ready chan struct{}) {
+	for i, waiter := range lb.waiters {
+		if waiter == ready {
+			lb.waiters = append(lb.waiters[:i], lb.waiters[i+1:]...)
+			break
+		}
+	}
+	lb.wake()
+}
+
+// wake tells the first waiting request that a backend may have become
+// available. It is called under the lock.
+func (lb *Balancer) wake() {
+	if len(lb.waiters) == 0 {
+		return
+	}
+	select {
+	case lb.waiters[0] <- struct{}{}:
+	default:
+	}
+}
+
+func (lb *Balancer) countRejected(err error) {
+	if err == errSaturated {
+		lb.rejected++
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type QueueSuite struct{}
+
+var _ = Suite(&QueueSuite{})
+
+type waitResult struct {
+	server *Server
+	err    error
+}
+
+func waitInQueue(lb *Balancer, ctx context.Context) chan waitResult {
+	lb.Lock()
+	queued := len(lb.waiters)
+	lb.Unlock()
+	result := make(chan waitResult, 1)
+	go func() {
+		server, err := lb.WaitServer(ctx, nil)
+		result <- waitResult{server, err}
+	}()
+	for {
+		lb.Lock()
+		n := len(lb.waiters)
+		lb.Unlock()
+		if n > queued {
+			return result
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *QueueSuite) TestWaitServer(c *C) {
+	lb := NewBalancer([]ServerConfig{{Addr: "server:8000", MaxConnections: 1}}, Options{
+		Queue: QueueConfig{Size: 2, Timeout: time.Minute},
+	})
+	server, err := lb.WaitServer(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(server.Connections, Equals, 1)
+
+	first := waitInQueue(lb, context.Background())
+	second := waitInQueue(lb, context.Background())
+	_, err = lb.WaitServer(context.Background(), nil)
+	c.Check(err, ErrorMatches, "all backends are at their connection limit, wait queue is full")
+	c.Check(errors.Is(err, errSaturated), Equals, true)
+
+	lb.release(server)
+	result := <-first
+	c.Assert(result.err, IsNil)
+	c.Check(result.server, Equals, server)
+	select {
+	case <-second:
+		c.Fatal("the second request jumped the connection limit")
+	case <-time.After(2 * queuePoll):
+	}
+	lb.release(server)
+	result = <-second
+	c.Assert(result.err, IsNil)
+	c.Check(lb.waiters, HasLen, 0)
+	c.Check(lb.rejected, Equals, int64(1))
+}
+
+func (s *QueueSuite) TestRecovery(c *C) {
+	lb := NewBalancer([]ServerConfig{{Addr: "server:8000"}}, Options{
+		Queue: QueueConfig{Size: 1, Timeout: time.Minute},
+	})
+	lb.Lock()
+	server := lb.servers[0]
+	server.Alive = false
+	lb.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := waitInQueue(lb, ctx)
+	cancel()
+	c.Check((<-canceled).err, Equals, context.Canceled)
+
+	result := waitInQueue(lb, context.Background())
+	lb.recordHealth(server, healthResult{At: time.Now(), OK: true})
+	c.Check((<-result).err, IsNil)
+}
+
+func (s *QueueSuite) TestDeadline(c *C) {
+	lb := NewBalancer([]ServerConfig{{Addr: "server:8000"}}, Options{
+		Queue: QueueConfig{Size: 1, Timeout: 10 * time.Millisecond},
+	})
+	c.Assert(lb.SetEnabled("server:8000", false), IsNil)
+
+	rw := httptest.NewRecorder()
+	serve(lb, RetryPolicy{Budget: NewRetryBudget(0, 0)}, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Check(rw.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(strings.TrimSpace(rw.Body.String()), Equals, "no server available after waiting 10ms in the queue")
+	c.Check(rw.Header().Get("Retry-After"), Equals, "")
+
+	lb = NewBalancer(nil, Options{})
+	_, err := lb.WaitServer(context.Background(), nil)
+	c.Check(err, Equals, errNoServer)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// maxRetryBody is the largest request body buffered for replaying it on
+// another backend. Requests with bigger bodies are never retried.
+const maxRetryBody = 1 << 20
+
+// RetryPolicy re-dispatches failed idempotent requests to other backends.
+type RetryPolicy struct {
+	// Attempts is the number of retries a single request may use.
+	Attempts int
+	Budget   *RetryBudget
+}
+
+// RetryBudget caps retries to a share of all requests. Every request
+// deposits Ratio tokens, every retry withdraws one, and the balance never
+// grows past a small reserve, so during an outage retries can add at most
+// Ratio extra load on top of the client traffic.
+type RetryBudget struct {
+	sync.Mutex
+	ratio   float64
+	reserve float64
+	balance float64
+}
+
+func NewRetryBudget(ratio, reserve float64) *RetryBudget {
+	return &RetryBudget{ratio: ratio, reserve: reserve, balance: reserve}
+}
+
+func (b *RetryBudget) deposit() {
+	b.Lock()
+	defer b.Unlock()
+	b.balance += b.ratio
+	if b.balance > b.reserve {
+		b.balance = b.reserve
+	}
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// idempotent reports whether r may safely be sent twice. Besides GET and
+// HEAD, clients can mark a request with an Idempotency-Key header, the
+// same convention net/http uses for its own retries.
+func idempotent(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	_, ok := r.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = r.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// replayable buffers the body of r so it can be sent again. It returns
+// false if r has to be forwarded only once, in which case its body is left
+// intact.
+func replayable(r *http.Request) ([]byte, bool) {
+	if !idempotent(r) {
+		return nil, false
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > maxRetryBody {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil || len(body) > maxRetryBody {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		return nil, false
+	}
+	return body, true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) TestBudget(c *C) {
+	budget := NewRetryBudget(0.5, 2)
+	c.Check(budget.withdraw(), Equals, true)
+	c.Check(budget.withdraw(), Equals, true)
+	c.Check(budget.withdraw(), Equals, false)
+
+	for i := 0; i < 10; i++ {
+		budget.deposit()
+	}
+	c.Check(budget.withdraw(), Equals, true)
+	c.Check(budget.withdraw(), Equals, true)
+	c.Check(budget.withdraw(), Equals, false)
+
+	budget.deposit()
+	c.Check(budget.withdraw(), Equals, false)
+	budget.deposit()
+	c.Check(budget.withdraw(), Equals, true)
+}
+
+func (s *RetrySuite) TestIdempotent(c *C) {
+	testCases := []struct {
+		method string
+		header string
+		result bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodPost, "", false},
+		{http.MethodPut, "", false},
+		{http.MethodPost, "Idempotency-Key", true},
+		{http.MethodDelete, "X-Idempotency-Key", true},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(testCase.method, "/", nil)
+		if testCase.header != "" {
+			req.Header.Set(testCase.header, "42")
+		}
+		c.Check(idempotent(req), Equals, testCase.result, Commentf("%s %s", testCase.method, testCase.header))
+	}
+}
+
+func (s *RetrySuite) TestServeRetries(c *C) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	var received []string
+	alive := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer alive.Close()
+
+	newBalancer := func() *Balancer {
+		return &Balancer{
+			Mutex: new(sync.Mutex),
+			servers: []*Server{
+				{Addr: strings.TrimPrefix(dead.URL, "http://"), Alive: true},
+				{Addr: strings.TrimPrefix(alive.URL, "http://"), Connections: 1, Alive: true},
+			},
+		}
+	}
+	policy := RetryPolicy{Attempts: 1, Budget: NewRetryBudget(1, 10)}
+
+	rw := httptest.NewRecorder()
+	serve(newBalancer(), policy, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Check(rw.Code, Equals, http.StatusOK)
+
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("value"))
+	req.Header.Set("Idempotency-Key", "1")
+	serve(newBalancer(), policy, rw, req)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(received, DeepEquals, []string{"", "value"})
+
+	rw = httptest.NewRecorder()
+	serve(newBalancer(), policy, rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("value")))
+	c.Check(rw.Code, Equals, http.StatusServiceUnavailable)
+
+	rw = httptest.NewRecorder()
+	serve(newBalancer(), RetryPolicy{Attempts: 1, Budget: NewRetryBudget(0, 0)}, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Check(rw.Code, Equals, http.StatusServiceUnavailable)
+}
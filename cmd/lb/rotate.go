@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is moved aside once it grows past
+// maxSize bytes. The previous files are kept as path.1, path.2 and so on,
+// path.1 being the newest, up to backups of them.
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	// retryAt is the size at which a failed rotation is tried again.
+	retryAt int64
+	// moved tells that the open file was moved aside but no new one could
+	// be opened in its place.
+	moved bool
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would not fit. A
+// single write is never split between files. If the rotation fails, the
+// writes go on to the current file and it is tried again once another
+// maxSize bytes are written.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize && f.size >= f.retryAt {
+		if err := f.rotate(); err != nil {
+			f.retryAt = f.size + f.maxSize
+			log.Printf("Cannot rotate %s, retrying in %d bytes: %s", f.path, f.maxSize, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the files aside while the current one is still open, so
+// that it is kept if any of the moves fails. If the new file can't be
+// opened, the current one is moved back, or left as path.1 for the next
+// rotation to only open the new file.
+func (f *rotatingFile) rotate() error {
+	if !f.moved {
+		if err := f.moveAside(); err != nil {
+			return err
+		}
+		f.moved = true
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		if f.backups > 0 && os.Rename(f.backup(1), f.path) == nil {
+			f.moved = false
+		}
+		return err
+	}
+	f.moved, f.retryAt = false, 0
+	if err := old.Close(); err != nil {
+		log.Printf("Failed to close the rotated %s: %s", f.path, err)
+	}
+	return nil
+}
+
+// moveAside shifts the backups and makes the current file the newest one.
+func (f *rotatingFile) moveAside() error {
+	if f.backups == 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.backups - 1; i > 0; i-- {
+		err := os.Rename(f.backup(i), f.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.backup(1))
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+func (f *rotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultPool is the name of the pool made of the top-level servers of the
+// configuration. It serves the requests no route matches.
+const defaultPool = "default"
+
+// Route sends the requests matching all of its conditions to a pool. Empty
+// conditions match anything, a header with an empty value only has to be
+// present.
+type Route struct {
+	Host   string            `json:"host,omitempty"`
+	Prefix string            `json:"prefix,omitempty"`
+	Method string            `json:"method,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+	Pool   string            `json:"pool"`
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.Host != "" && !strings.EqualFold(route.Host, hostname(r.Host)) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, route.Prefix) {
+		return false
+	}
+	if route.Method != "" && route.Method != r.Method {
+		return false
+	}
+	for name, value := range route.Header {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || value != "" && !containsValue(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// conditions counts the conditions of the route besides the prefix.
+func (route *Route) conditions() int {
+	n := len(route.Header)
+	if route.Host != "" {
+		n++
+	}
+	if route.Method != "" {
+		n++
+	}
+	return n
+}
+
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return host
+}
+
+func containsValue(values []string, value string) bool {
+	for _, next := range values {
+		if next == value {
+			return true
+		}
+	}
+	return false
+}
+
+// newPools creates the balancers of the default and the configured pools.
+// Every pool gets its own strategy, the options hold the settings the pool
+// configuration overrides.
+func newPools(config *Config, strategy, hashKey string, options Options) (map[string]*Balancer, error) {
+	configs := map[string]PoolConfig{defaultPool: {Servers: config.Servers}}
+	for name, pool := range config.Pools {
+		configs[name] = pool
+	}
+	pools := map[string]*Balancer{}
+	for name, pool := range configs {
+		if pool.Strategy == "" {
+			pool.Strategy = strategy
+		}
+		if pool.HashKey == "" {
+			pool.HashKey = hashKey
+		}
+		selector, err := NewStrategy(pool.Strategy, pool.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		poolOptions := options
+		poolOptions.Name = name
+		poolOptions.Affinity = options.Affinity.forPool(name)
+		poolOptions.Strategy = selector
+		poolOptions.Health = pool.Health.merge(options.Health)
+		poolOptions.Transport = pool.Transport.merge(options.Transport)
+		pools[name] = NewBalancer(pool.Servers, poolOptions)
+	}
+	return pools, nil
+}
+
+// Router dispatches requests to the balancers of the named pools.
+type Router struct {
+	routes []Route
+	pools  map[string]*Balancer
+}
+
+// NewRouter checks that every route leads to one of the pools, which must
+// include the default one.
+func NewRouter(routes []Route, pools map[string]*Balancer) (*Router, error) {
+	if pools[defaultPool] == nil {
+		return nil, fmt.Errorf("no %s pool", defaultPool)
+	}
+	for i, route := range routes {
+		if pools[route.Pool] == nil {
+			return nil, fmt.Errorf("route %d leads to unknown pool %q", i, route.Pool)
+		}
+	}
+	sorted := append([]Route(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if len(sorted[i].Prefix) != len(sorted[j].Prefix) {
+			return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+		}
+		return sorted[i].conditions() > sorted[j].conditions()
+	})
+	return &Router{routes: sorted, pools: pools}, nil
+}
+
+// Route returns the pool of the matching route with the longest path
+// prefix. Of the routes with the same prefix the one with more conditions
+// wins, then the one that comes first in the configuration. Requests no
+// route matches go to the default pool.
+func (rt *Router) Route(r *http.Request) (string, *Balancer) {
+	for i := range rt.routes {
+		if rt.routes[i].matches(r) {
+			return rt.routes[i].Pool, rt.pools[rt.routes[i].Pool]
+		}
+	}
+	return defaultPool, rt.pools[defaultPool]
+}
+
+// Pool returns the balancer of the named pool, nil if there is none.
+func (rt *Router) Pool(name string) *Balancer {
+	return rt.pools[name]
+}
+
+// Pools returns the pool names in alphabetical order.
+func (rt *Router) Pools() []string {
+	var names []string
+	for name := range rt.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type RouteSuite struct{}
+
+var _ = Suite(&RouteSuite{})
+
+func (s *RouteSuite) TestRoute(c *C) {
+	pools := map[string]*Balancer{}
+	for _, name := range []string{defaultPool, "api", "db", "v2", "admin", "write"} {
+		pools[name] = NewBalancer(nil, Options{Name: name})
+	}
+	router, err := NewRouter([]Route{
+		{Prefix: "/api/", Pool: "api"},
+		{Prefix: "/db/", Pool: "db"},
+		{Prefix: "/api/v2/", Pool: "v2"},
+		{Host: "admin.example.com", Pool: "admin"},
+		{Prefix: "/api/", Header: map[string]string{"X-Canary": ""}, Pool: "v2"},
+		{Prefix: "/db/", Method: http.MethodPost, Header: map[string]string{"X-Mode": "write"}, Pool: "write"},
+	}, pools)
+	c.Assert(err, IsNil)
+
+	testCases := []struct {
+		method string
+		target string
+		header string
+		value  string
+		pool   string
+	}{
+		{http.MethodGet, "/", "", "", defaultPool},
+		{http.MethodGet, "/api/v1/some-data?key=a", "", "", "api"},
+		{http.MethodGet, "/api/v2/some-data", "", "", "v2"},
+		{http.MethodGet, "/api", "", "", defaultPool},
+		{http.MethodGet, "/db/key", "", "", "db"},
+		{http.MethodPost, "/db/key", "X-Mode", "write", "write"},
+		{http.MethodPost, "/db/key", "X-Mode", "read", "db"},
+		{http.MethodGet, "/db/key", "X-Mode", "write", "db"},
+		{http.MethodGet, "http://admin.example.com:8090/stats", "", "", "admin"},
+		{http.MethodGet, "http://ADMIN.example.com/api/", "", "", "api"},
+		{http.MethodGet, "/api/v1/some-data", "X-Canary", "1", "v2"},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(testCase.method, testCase.target, nil)
+		if testCase.header != "" {
+			req.Header.Set(testCase.header, testCase.value)
+		}
+		name, lb := router.Route(req)
+		c.Check(name, Equals, testCase.pool, Commentf("%s %s", testCase.method, testCase.target))
+		c.Check(lb, Equals, pools[testCase.pool])
+	}
+
+	_, err = NewRouter([]Route{{Prefix: "/", Pool: "cache"}}, pools)
+	c.Check(err, ErrorMatches, `route 0 leads to unknown pool "cache"`)
+	_, err = NewRouter(nil, map[string]*Balancer{"api": pools["api"]})
+	c.Check(err, NotNil)
+}
+
+func (s *RouteSuite) TestPools(c *C) {
+	config := &Config{
+		Servers: []ServerConfig{{Addr: "server1:8080"}},
+		Pools: map[string]PoolConfig{
+			"db": {
+				Strategy: consistentHashStrategy,
+				HashKey:  "uri",
+				Health:   HealthCheckConfig{Path: "/ping"},
+				Servers:  []ServerConfig{{Addr: "db:18080"}},
+			},
+		},
+	}
+	c.Assert(config.validate(), IsNil)
+	pools, err := newPools(config, roundRobinStrategy, "query:key", Options{
+		Health: HealthCheckConfig{Path: "/health", Rise: 2},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(pools, HasLen, 2)
+	c.Check(pools[defaultPool].strategy, FitsTypeOf, &weightedRoundRobin{})
+	c.Check(pools[defaultPool].health.Path, Equals, "/health")
+	c.Check(pools["db"].strategy, FitsTypeOf, &consistentHash{})
+	c.Check(pools["db"].health, DeepEquals, HealthCheckConfig{Path: "/ping", Rise: 2})
+	c.Check(pools["db"].name, Equals, "db")
+	c.Check(pools["db"].Servers()[0].Addr, Equals, "db:18080")
+
+	config.Pools["db"] = PoolConfig{Strategy: "fastest"}
+	_, err = newPools(config, roundRobinStrategy, "query:key", Options{})
+	c.Check(err, NotNil)
+
+	config.Routes = []Route{{Prefix: "/db/", Pool: "cache"}}
+	c.Check(config.validate(), ErrorMatches, `route 0 leads to unknown pool "cache"`)
+	config.Routes = []Route{{Prefix: "/db/", Pool: defaultPool}}
+	c.Check(config.validate(), IsNil)
+	config.Pools[defaultPool] = PoolConfig{}
+	c.Check(config.validate(), NotNil)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	roundRobinStrategy         = "round-robin"
+	weightedRoundRobinStrategy = "weighted-round-robin"
+	leastConnectionsStrategy   = "least-connections"
+	randomTwoChoicesStrategy   = "random-two-choices"
+	consistentHashStrategy     = "consistent-hash"
+)
+
+var strategyNames = strings.Join([]string{
+	roundRobinStrategy,
+	weightedRoundRobinStrategy,
+	leastConnectionsStrategy,
+	randomTwoChoicesStrategy,
+	consistentHashStrategy,
+}, ", ")
+
+// hashReplicas is the number of points every backend gets on the
+// consistent hash ring.
+const hashReplicas = 100
+
+// Strategy decides which backend serves a request.
+type Strategy interface {
+	// Next picks one of the servers, which is never empty and contains
+	// only backends able to take the request. It is called with the
+	// balancer locked, so implementations may keep unsynchronized state.
+	Next(servers []*Server, r *http.Request) *Server
+}
+
+// NewStrategy creates the strategy called name. hashKey tells the
+// consistent-hash strategy which request attribute to hash, see
+// parseHashKey; other strategies ignore it.
+func NewStrategy(name, hashKey string) (Strategy, error) {
+	switch name {
+	case roundRobinStrategy, weightedRoundRobinStrategy:
+		// Round-robin honours the weights as every strategy does, so the
+		// two names stand for the same thing.
+		return &weightedRoundRobin{}, nil
+	case leastConnectionsStrategy:
+		return leastConnections{}, nil
+	case randomTwoChoicesStrategy:
+		return &randomTwoChoices{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case consistentHashStrategy:
+		key, err := parseHashKey(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
+
+// weightedRoundRobin is the smooth weighted round-robin used by nginx: it
+// interleaves the backends instead of sending bursts to the heaviest one.
+type weightedRoundRobin struct {
+	current map[string]float64
+}
+
+func (s *weightedRoundRobin) Next(servers []*Server, _ *http.Request) *Server {
+	if s.current == nil || len(s.current) > len(servers) {
+		current := make(map[string]float64, len(servers))
+		for _, server := range servers {
+			current[server.Addr] = s.current[server.Addr]
+		}
+		s.current = current
+	}
+
+	var best *Server
+	total := 0.0
+	for _, server := range servers {
+		s.current[server.Addr] += server.weight()
+		total += server.weight()
+		if best == nil || s.current[server.Addr] > s.current[best.Addr] {
+			best = server
+		}
+	}
+	s.current[best.Addr] -= total
+	return best
+}
+
+// leastConnections picks the backend with the fewest connections per unit
+// of weight. Counting the connection about to be opened keeps idle
+// backends apart by weight too.
+type leastConnections struct{}
+
+func (leastConnections) Next(servers []*Server, _ *http.Request) *Server {
+	min := servers[0]
+	for _, next := range servers {
+		if next.load() < min.load() {
+			min = next
+		}
+	}
+	return min
+}
+
+// randomTwoChoices samples two distinct backends and takes the less loaded
+// one, which avoids herding on a single least-loaded server.
+type randomTwoChoices struct {
+	rand *rand.Rand
+}
+
+func (s *randomTwoChoices) Next(servers []*Server, _ *http.Request) *Server {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	i := s.rand.Intn(len(servers))
+	j := s.rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	if servers[j].load() < servers[i].load() {
+		return servers[j]
+	}
+	return servers[i]
+}
+
+type ringNode struct {
+	hash   uint32
+	server *Server
+}
+
+// requestKey extracts the attribute a request is routed by. ok is false if
+// the request does not carry it.
+type requestKey func(r *http.Request) (key string, ok bool)
+
+// parseHashKey understands "uri", "query:<name>", "header:<name>" and
+// "cookie:<name>".
+func parseHashKey(spec string) (requestKey, error) {
+	if spec == "uri" {
+		return func(r *http.Request) (string, bool) {
+			return r.URL.RequestURI(), true
+		}, nil
+	}
+	i := strings.Index(spec, ":")
+	if i < 0 || i == len(spec)-1 {
+		return nil, fmt.Errorf("invalid hash key %q", spec)
+	}
+	source, name := spec[:i], spec[i+1:]
+	switch source {
+	case "query":
+		return func(r *http.Request) (string, bool) {
+			values, ok := r.URL.Query()[name]
+			if !ok || len(values) == 0 {
+				return "", false
+			}
+			return values[0], true
+		}, nil
+	case "header":
+		return func(r *http.Request) (string, bool) {
+			value := r.Header.Get(name)
+			return value, value != ""
+		}, nil
+	case "cookie":
+		return func(r *http.Request) (string, bool) {
+			cookie, err := r.Cookie(name)
+			if err != nil {
+				return "", false
+			}
+			return cookie.Value, true
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid hash key source %q", source)
+}
+
+// consistentHash maps a request attribute onto a ring of virtual nodes, so
+// the same key keeps hitting the same backend. The ring is rebuilt from the
+// available backends only, and as every backend keeps its points on it,
+// losing one of N backends moves just the keys it owned, about 1/N of them.
+// Backends get points in proportion to their Weight; the slow start is not
+// applied, as changing the ring on every request would move the keys back
+// and forth. Requests without the key are balanced by connections.
+type consistentHash struct {
+	key     requestKey
+	members []*Server
+	ring    []ringNode
+}
+
+func (s *consistentHash) Next(servers []*Server, r *http.Request) *Server {
+	if r == nil {
+		return leastConnections{}.Next(servers, r)
+	}
+	key, ok := s.key(r)
+	if !ok {
+		return leastConnections{}.Next(servers, r)
+	}
+	if !s.builtFor(servers) {
+		s.build(servers)
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= hash
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].server
+}
+
+func (s *consistentHash) builtFor(servers []*Server) bool {
+	if len(servers) != len(s.members) {
+		return false
+	}
+	for i := range servers {
+		if servers[i] != s.members[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *consistentHash) build(servers []*Server) {
+	s.members = append(s.members[:0], servers...)
+	s.ring = s.ring[:0]
+	for _, server := range servers {
+		weight := server.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		for i := 0; i < hashReplicas*weight; i++ {
+			hash := crc32.ChecksumIEEE([]byte(server.Addr + "#" + strconv.Itoa(i)))
+			s.ring = append(s.ring, ringNode{hash, server})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i].hash < s.ring[j].hash
+	})
+}
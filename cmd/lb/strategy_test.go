@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type StrategySuite struct{}
+
+var _ = Suite(&StrategySuite{})
+
+func (s *StrategySuite) TestStrategies(c *C) {
+	testCases := []struct {
+		name     string
+		strategy Strategy
+		servers  []*Server
+		expected []string
+	}{
+		{
+			name:     "round robin",
+			strategy: &weightedRoundRobin{},
+			servers: []*Server{
+				{Addr: "a", Weight: 1},
+				{Addr: "b", Weight: 1},
+				{Addr: "c", Weight: 1},
+			},
+			expected: []string{"a", "b", "c", "a", "b"},
+		},
+		{
+			name:     "weighted round robin",
+			strategy: &weightedRoundRobin{},
+			servers: []*Server{
+				{Addr: "a", Weight: 5},
+				{Addr: "b", Weight: 1},
+				{Addr: "c", Weight: 1},
+			},
+			expected: []string{"a", "a", "b", "a", "c", "a", "a"},
+		},
+		{
+			name:     "least connections",
+			strategy: leastConnections{},
+			servers: []*Server{
+				{Addr: "a", Weight: 1, Connections: 3},
+				{Addr: "b", Weight: 1, Connections: 1},
+				{Addr: "c", Weight: 1, Connections: 1},
+			},
+			expected: []string{"b", "b"},
+		},
+		{
+			name:     "weighted least connections",
+			strategy: leastConnections{},
+			servers: []*Server{
+				{Addr: "a", Weight: 1, Connections: 2},
+				{Addr: "b", Weight: 4, Connections: 6},
+				{Addr: "c", Weight: 2, Connections: 4},
+			},
+			expected: []string{"b", "b"},
+		},
+		{
+			name:     "least connections on idle servers",
+			strategy: leastConnections{},
+			servers: []*Server{
+				{Addr: "a", Weight: 1},
+				{Addr: "b", Weight: 3},
+			},
+			expected: []string{"b"},
+		},
+		{
+			name:     "random two choices",
+			strategy: &randomTwoChoices{rand: rand.New(rand.NewSource(1))},
+			servers: []*Server{
+				{Addr: "a", Weight: 1, Connections: 4},
+				{Addr: "b", Weight: 1, Connections: 1},
+			},
+			expected: []string{"b", "b", "b"},
+		},
+		{
+			name:     "weighted random two choices",
+			strategy: &randomTwoChoices{rand: rand.New(rand.NewSource(1))},
+			servers: []*Server{
+				{Addr: "a", Weight: 1, Connections: 2},
+				{Addr: "b", Weight: 5, Connections: 5},
+			},
+			expected: []string{"b", "b", "b"},
+		},
+		{
+			name:     "random two choices with one server",
+			strategy: &randomTwoChoices{rand: rand.New(rand.NewSource(1))},
+			servers: []*Server{
+				{Addr: "a", Weight: 1, Connections: 4},
+			},
+			expected: []string{"a", "a"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		var picked []string
+		for range testCase.expected {
+			picked = append(picked, testCase.strategy.Next(testCase.servers, req).Addr)
+		}
+		c.Check(picked, DeepEquals, testCase.expected, Commentf(testCase.name))
+	}
+}
+
+func (s *StrategySuite) TestConsistentHash(c *C) {
+	servers := []*Server{
+		{Addr: "server:8000", Weight: 1},
+		{Addr: "server:8001", Weight: 1},
+		{Addr: "server:8002", Weight: 1},
+		{Addr: "server:8003", Weight: 1},
+	}
+	strategy, err := NewStrategy(consistentHashStrategy, "query:key")
+	c.Assert(err, IsNil)
+
+	const keys = 4000
+	owners := make(map[string]string)
+	hits := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/some-data?key=%d", i), nil)
+		server := strategy.Next(servers, req)
+		c.Check(strategy.Next(servers, req), Equals, server)
+		owners[req.URL.RawQuery] = server.Addr
+		hits[server.Addr]++
+	}
+	for _, server := range servers {
+		c.Check(hits[server.Addr] > keys/len(servers)/2, Equals, true, Commentf("%s got %d keys", server.Addr, hits[server.Addr]))
+	}
+
+	down := servers[1]
+	alive := []*Server{servers[0], servers[2], servers[3]}
+	moved := 0
+	for i := 0; i < keys; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/some-data?key=%d", i), nil)
+		server := strategy.Next(alive, req)
+		if server.Addr != owners[req.URL.RawQuery] {
+			moved++
+			c.Check(owners[req.URL.RawQuery], Equals, down.Addr)
+		}
+	}
+	c.Check(moved, Equals, hits[down.Addr])
+}
+
+func (s *StrategySuite) TestHashKey(c *C) {
+	req := httptest.NewRequest("GET", "/api/v1/some-data?key=bluemars", nil)
+	req.Header.Set("X-User", "alice")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	testCases := []struct {
+		spec string
+		key  string
+		ok   bool
+	}{
+		{"uri", "/api/v1/some-data?key=bluemars", true},
+		{"query:key", "bluemars", true},
+		{"query:id", "", false},
+		{"header:X-User", "alice", true},
+		{"header:X-Tenant", "", false},
+		{"cookie:session", "s1", true},
+		{"cookie:user", "", false},
+	}
+	for _, testCase := range testCases {
+		key, err := parseHashKey(testCase.spec)
+		c.Assert(err, IsNil)
+		value, ok := key(req)
+		c.Check(value, Equals, testCase.key, Commentf(testCase.spec))
+		c.Check(ok, Equals, testCase.ok, Commentf(testCase.spec))
+	}
+
+	for _, spec := range []string{"", "key", "query:", "body:key"} {
+		_, err := parseHashKey(spec)
+		c.Check(err, NotNil, Commentf(spec))
+	}
+}
+
+func (s *StrategySuite) TestNewStrategy(c *C) {
+	for _, name := range []string{
+		roundRobinStrategy,
+		weightedRoundRobinStrategy,
+		leastConnectionsStrategy,
+		randomTwoChoicesStrategy,
+		consistentHashStrategy,
+	} {
+		strategy, err := NewStrategy(name, "query:key")
+		c.Check(err, IsNil)
+		c.Check(strategy, NotNil)
+	}
+	_, err := NewStrategy("fastest", "query:key")
+	c.Check(err, ErrorMatches, `unknown strategy "fastest"`)
+	_, err = NewStrategy(consistentHashStrategy, "body:key")
+	c.Check(err, ErrorMatches, `invalid hash key source "body"`)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogaeva/balancer/httptools"
+	"golang.org/x/net/http2"
+)
+
+const (
+	http1Protocol = "http1"
+	h2Protocol    = "h2"
+	h2cProtocol   = "h2c"
+)
+
+// TransportConfig tunes the connections to a backend. Zero fields are
+// inherited from the balancer defaults, see merge.
+type TransportConfig struct {
+	// Protocol is http1, h2 for HTTP/2 over TLS falling back to HTTP/1.1
+	// if the backend does not offer it, or h2c for cleartext HTTP/2 with
+	// prior knowledge.
+	Protocol string `json:"protocol,omitempty"`
+	// MaxIdlePerHost is the number of idle HTTP/1.1 connections kept
+	// open. HTTP/2 multiplexes the requests over a single connection, so
+	// h2c ignores it.
+	MaxIdlePerHost int `json:"maxIdlePerHost,omitempty"`
+	// IdleTimeout closes connections unused for that long. It does not
+	// apply to h2c, whose connections are checked with pings instead.
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
+}
+
+// merge returns c with its zero fields taken from defaults.
+func (c TransportConfig) merge(defaults TransportConfig) TransportConfig {
+	if c.Protocol == "" {
+		c.Protocol = defaults.Protocol
+	}
+	if c.MaxIdlePerHost == 0 {
+		c.MaxIdlePerHost = defaults.MaxIdlePerHost
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaults.IdleTimeout
+	}
+	return c
+}
+
+// h2cPingPeriod is how long an h2c connection may stay silent before it
+// is pinged to check it is still alive.
+const h2cPingPeriod = 30 * time.Second
+
+// newTransport creates the transport to a backend, tlsConfig is used for
+// the HTTPS ones.
+func newTransport(config TransportConfig, tlsConfig *tls.Config) (http.RoundTripper, error) {
+	switch config.Protocol {
+	case "", http1Protocol, h2Protocol:
+	case h2cProtocol:
+		return &http2.Transport{
+			AllowHTTP: true,
+			// This transport dials without the request context, so only
+			// the dialer timeout keeps an unreachable backend from holding
+			// the requests and health checks for minutes.
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+				return dialer.Dial(network, addr)
+			},
+			ReadIdleTimeout: h2cPingPeriod,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", config.Protocol)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.MaxIdlePerHost
+	transport.MaxIdleConns = 0
+	if config.IdleTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(config.IdleTimeout)
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	if config.Protocol == h2Protocol {
+		if _, err := http2.ConfigureTransports(transport); err != nil {
+			return nil, err
+		}
+	} else {
+		// A non-nil empty map disables the HTTP/2 upgrade over TLS.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport, nil
+}
+
+// backendTLS configures the connections to HTTPS backends. caFile replaces
+// the system roots the backends are verified with, certFile and keyFile are
+// the client certificate presented to them. All of them are optional.
+func backendTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// certPairs matches the comma-separated lists of certificate and key files.
+func certPairs(certFiles, keyFiles string) ([]httptools.CertPair, error) {
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("got %d certificates and %d keys", len(certs), len(keys))
+	}
+	pairs := make([]httptools.CertPair, len(certs))
+	for i := range certs {
+		pairs[i] = httptools.CertPair{
+			CertFile: strings.TrimSpace(certs[i]),
+			KeyFile:  strings.TrimSpace(keys[i]),
+		}
+	}
+	return pairs, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	. "gopkg.in/check.v1"
+)
+
+type TransportSuite struct{}
+
+var _ = Suite(&TransportSuite{})
+
+// backendFor starts a backend speaking protocol and returns it with the
+// TLS configuration trusting it.
+func backendFor(protocol string) (*httptest.Server, *tls.Config) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("x-proto", r.Proto)
+		_, _ = rw.Write([]byte("OK"))
+	})
+	switch protocol {
+	case h2cProtocol:
+		return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{})), nil
+	case h2Protocol:
+		backend := httptest.NewUnstartedServer(handler)
+		backend.EnableHTTP2 = true
+		backend.StartTLS()
+		roots := x509.NewCertPool()
+		roots.AddCert(backend.Certificate())
+		return backend, &tls.Config{RootCAs: roots}
+	}
+	return httptest.NewServer(handler), nil
+}
+
+func withScheme(protocol string, f func()) {
+	defer func(enabled bool) { *https = enabled }(*https)
+	*https = protocol == h2Protocol
+	f()
+}
+
+func (s *TransportSuite) TestProtocols(c *C) {
+	for protocol, proto := range map[string]string{
+		http1Protocol: "HTTP/1.1",
+		h2Protocol:    "HTTP/2.0",
+		h2cProtocol:   "HTTP/2.0",
+	} {
+		backend, tlsConfig := backendFor(protocol)
+		transport, err := newTransport(TransportConfig{Protocol: protocol, MaxIdlePerHost: 4}, tlsConfig)
+		c.Assert(err, IsNil)
+
+		rw := httptest.NewRecorder()
+		withScheme(protocol, func() {
+			_, err = forward(backend.Listener.Addr().String(), transport, rw, httptest.NewRequest("GET", "/", nil))
+		})
+		c.Check(err, IsNil, Commentf(protocol))
+		c.Check(rw.Header().Get("x-proto"), Equals, proto, Commentf(protocol))
+		backend.Close()
+	}
+
+	_, err := newTransport(TransportConfig{Protocol: "spdy"}, nil)
+	c.Check(err, ErrorMatches, `unknown protocol "spdy"`)
+}
+
+func (s *TransportSuite) TestH2CDialTimeout(c *C) {
+	defer func(saved time.Duration) { timeout = saved }(timeout)
+	timeout = 100 * time.Millisecond
+	transport, err := newTransport(TransportConfig{Protocol: h2cProtocol}, nil)
+	c.Assert(err, IsNil)
+
+	// The address is not routed, so the connection is never answered.
+	start := time.Now()
+	_, err = forward("10.255.255.1:80", transport, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Check(err, NotNil)
+	c.Check(time.Since(start) < 2*time.Second, Equals, true)
+}
+
+func benchmarkProtocol(b *testing.B, protocol string) {
+	backend, tlsConfig := backendFor(protocol)
+	defer backend.Close()
+	transport, err := newTransport(TransportConfig{Protocol: protocol, MaxIdlePerHost: 64}, tlsConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dst := strings.TrimPrefix(strings.TrimPrefix(backend.URL, "http://"), "https://")
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	withScheme(protocol, func() {
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rw := httptest.NewRecorder()
+				if _, err := forward(dst, transport, rw, httptest.NewRequest("GET", "/", nil)); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkTransport_HTTP1(b *testing.B) {
+	benchmarkProtocol(b, http1Protocol)
+}
+
+func BenchmarkTransport_H2(b *testing.B) {
+	benchmarkProtocol(b, h2Protocol)
+}
+
+func BenchmarkTransport_H2C(b *testing.B) {
+	benchmarkProtocol(b, h2cProtocol)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	"github.com/gogaeva/balancer/httptools"
 )
 
 const reportMaxLen = 100
@@ -12,12 +14,12 @@ type Report map[string][]string
 
 func (r Report) Process(req *http.Request) {
 	author := req.Header.Get("lb-author")
-	counter := req.Header.Get("lb-req-cnt")
-	log.Printf("GET some-data from [%s] request [%s]", author, counter)
+	id := req.Header.Get(httptools.RequestIDHeader)
+	log.Printf("GET some-data from [%s] request [%s]", author, id)
 
 	if len(author) > 0 {
 		list := r[author]
-		list = append(list, counter)
+		list = append(list, id)
 		if len(list) > reportMaxLen {
 			list = list[len(list)-reportMaxLen:]
 		}
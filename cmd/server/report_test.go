@@ -9,7 +9,7 @@ import (
 func TestReport_Process(t *testing.T) {
 	req := httptest.NewRequest("GET", "/", nil)
 	req.Header.Set("lb-author", "test-author")
-	req.Header.Set("lb-req-cnt", "1")
+	req.Header.Set("X-Request-ID", "1")
 
 	r := make(Report)
 
@@ -18,7 +18,7 @@ func TestReport_Process(t *testing.T) {
 		t.Errorf("Unexpected report state %s", r)
 	}
 
-	req.Header.Set("lb-req-cnt", "2")
+	req.Header.Set("X-Request-ID", "2")
 	r.Process(req)
 	if !reflect.DeepEqual(r["test-author"], []string{"1", "2"}) {
 		t.Errorf("Unexpected report state %s", r)
@@ -26,7 +26,7 @@ func TestReport_Process(t *testing.T) {
 
 	req.Header.Set("lb-author", "test-len")
 	for i := 0; i < 103; i++ {
-		req.Header.Set("lb-req-cnt", "test-len")
+		req.Header.Set("X-Request-ID", "test-len")
 		r.Process(req)
 	}
 	if len(r["test-len"]) != reportMaxLen {
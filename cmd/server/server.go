@@ -17,6 +17,7 @@ import (
 
 var port = flag.Int("port", 8080, "server port")
 var db = flag.String("database", "http://database:18080/db/", "server database")
+var drainTime = flag.Duration("shutdown-timeout", 15*time.Second, "how long active requests may take to finish on shutdown")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
@@ -60,7 +61,16 @@ func main() {
 			return
 		}
 
-		resp, err := http.Get(*db + key[0])
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, *db+key[0], nil)
+		if err != nil {
+			log.Printf("Error creating request to database: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if trace, ok := httptools.TraceFrom(r.Context()); ok {
+			trace.Inject(req.Header)
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			log.Printf("Error sending request to database: %s", err)
 			rw.WriteHeader(http.StatusInternalServerError)
@@ -93,8 +103,9 @@ func main() {
 	})
 
 	h.Handle("/report", report)
+	h.Handle("/metrics", httptools.DefaultRegistry)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, httptools.Tracing(httptools.Instrument(h)))
 	date := time.Now().Format("January 1, 2001")
 	res, err := http.Post(*db+"bluemars", "application/json", bytes.NewBuffer([]byte(fmt.Sprintf(`{"value": "%s"}`, date))))
 	if err != nil || res.StatusCode != http.StatusOK {
@@ -104,4 +115,5 @@ func main() {
 	log.Printf("Sent value %s", date)
 	server.Start()
 	signal.WaitForTerminationSignal()
+	httptools.Shutdown(*drainTime, server)
 }
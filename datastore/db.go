@@ -1,75 +1,327 @@
 package datastore
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const DefaultSegmentSize int64 = (1 << 20) * 10
 const segmentPrefix = "segment"
 
+const (
+	// A merge is written to a file with mergingSuffix, which is renamed to
+	// one with mergedSuffix once it is complete and synced. The rename
+	// commits the merge: the merged file replaces the segments up to its
+	// number, even if the process stops before they are removed.
+	mergingSuffix = ".merging"
+	mergedSuffix  = ".merged"
+	// legacyMerged is the name of the merged segment of the older versions,
+	// which hold the oldest data.
+	legacyMerged = segmentPrefix + "-merged"
+)
+
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+// ErrClosed is returned by the writes to a closed Db.
+var ErrClosed = errors.New("database is closed")
+
+// ErrCorrupt is the error of a record that fails its checksum or whose
+// lengths don't add up, ErrTornWrite of one cut short at the end of a
+// segment file.
+var (
+	ErrCorrupt   = errors.New("record is corrupted")
+	ErrTornWrite = errors.New("record is incomplete")
+)
+
+// Damage locates a damaged record in a segment file.
+type Damage struct {
+	Segment string
+	Offset  int64
+	Err     error
+}
+
+// CompactionPolicy tells when the full segments are merged. A merge starts
+// when a segment is full and the full ones number at least Segments, or
+// when at least GarbageRatio of their bytes are taken by the overwritten
+// and deleted entries. Zero values disable the conditions.
+type CompactionPolicy struct {
+	Segments     int
+	GarbageRatio float64
+}
+
+// DefaultCompaction merges the full segments when there are two of them or
+// half of their space is wasted.
+var DefaultCompaction = CompactionPolicy{Segments: 2, GarbageRatio: 0.5}
+
+func (p CompactionPolicy) due(segments []*segment) bool {
+	if len(segments) == 0 {
+		return false
+	}
+	if p.Segments > 0 && len(segments) >= p.Segments {
+		return true
+	}
+	if p.GarbageRatio > 0 {
+		garbage, total := garbage(segments)
+		return total > 0 && float64(garbage) >= p.GarbageRatio*float64(total)
+	}
+	return false
+}
+
+// SyncMode tells when the writes are synced to the disk.
+type SyncMode int
+
+const (
+	// NoSync leaves the writes to the operating system, they may be lost
+	// if it stops.
+	NoSync SyncMode = iota
+	// SyncEveryWrite syncs every write before it is acknowledged.
+	SyncEveryWrite
+	// GroupCommit syncs the writes in batches and holds their
+	// acknowledgements until then.
+	GroupCommit
+)
+
+// defaultGroupInterval is the longest a write waits for its batch to be
+// synced if SyncPolicy sets no Interval.
+const defaultGroupInterval = 10 * time.Millisecond
+
+// SyncPolicy is the durability of the writes. With GroupCommit a batch is
+// synced Interval after its first write or once it has Writes of them,
+// whichever comes first, zero Writes don't limit the batch size.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration
+	Writes   int
+}
+
+// Option customizes a Db made by NewDb.
+type Option func(db *Db)
+
+// Compaction replaces DefaultCompaction with policy.
+func Compaction(policy CompactionPolicy) Option {
+	return func(db *Db) {
+		db.policy = policy
+	}
+}
+
+// Durability replaces NoSync with policy.
+func Durability(policy SyncPolicy) Option {
+	return func(db *Db) {
+		if policy.Mode == GroupCommit && policy.Interval <= 0 {
+			policy.Interval = defaultGroupInterval
+		}
+		db.durability = policy
+	}
+}
+
+// Db is safe for concurrent use. Writes are applied one at a time by a
+// writer goroutine, the full segments are merged in the background, and
+// reads go through the indexes under mu.
 type Db struct {
-	dirPath  string
+	dirPath    string
+	segSize    int64
+	policy     CompactionPolicy
+	durability SyncPolicy
+
+	// mu guards the segment list, the segment indexes and the merge state.
+	// The writer and the merge take it only to change them, the writer
+	// appends to the last segment and the merge replaces the others.
+	mu       sync.RWMutex
 	segments []*segment
-	segSize  int64
+
+	merging    bool
+	compaction sync.WaitGroup
+	merges     int
+	mergeTime  time.Duration
+
+	writes    chan write
+	closing   chan struct{}
+	closeOnce sync.Once
+	stopped   chan struct{}
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+// write is a request to the writer goroutine, which sends back the outcome
+// to done.
+type write struct {
+	entry entry
+	done  chan error
+}
+
+// Stats describes the storage state of a Db.
+type Stats struct {
+	Segments int
+	// Bytes is the size of all the segment files and Garbage is the part
+	// of it a merge of all of them would free.
+	Bytes   int64
+	Garbage int64
+	// Merges counts the segment merges since the Db was opened and
+	// MergeTime is the total time they took.
+	Merges    int
+	MergeTime time.Duration
+}
+
+func NewDb(dir string, segmentSize int64, options ...Option) (*Db, error) {
 	db := &Db{
 		dirPath:  dir,
 		segments: nil,
 		segSize:  segmentSize,
+		policy:   DefaultCompaction,
+		writes:   make(chan write),
+		closing:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, option := range options {
+		option(db)
 	}
 	err := db.init()
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	go db.writer()
 	return db, nil
 }
 
+// init opens the segments in the order of their numbers. It completes the
+// merges that were committed but not finished and removes the ones that
+// were not.
 func (db *Db) init() error {
 	contents, err := ioutil.ReadDir(db.dirPath)
 	if err != nil {
 		return err
 	}
-	var segments []*segment
+	segmentFiles := map[int]string{}
+	var merged []int
 	for _, file := range contents {
-		if !file.IsDir() && strings.HasPrefix(file.Name(), segmentPrefix) {
-			segment, err := initSegment(filepath.Join(db.dirPath, file.Name()))
-			if err != nil {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, segmentPrefix) {
+			continue
+		}
+		path := filepath.Join(db.dirPath, name)
+		switch {
+		case strings.HasSuffix(name, mergingSuffix):
+			if err := os.Remove(path); err != nil {
 				return err
 			}
+		case strings.HasSuffix(name, mergedSuffix):
+			if id, ok := segmentID(strings.TrimSuffix(name, mergedSuffix)); ok {
+				merged = append(merged, id)
+			}
+		default:
+			if id, ok := segmentID(name); ok {
+				segmentFiles[id] = path
+			}
+		}
+	}
 
-			segments = append(segments, segment)
+	sort.Ints(merged)
+	for _, mergedID := range merged {
+		for id, path := range segmentFiles {
+			if id <= mergedID {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				delete(segmentFiles, id)
+			}
+		}
+		path := db.segmentPath(mergedID)
+		if err := os.Rename(path+mergedSuffix, path); err != nil {
+			return err
+		}
+		segmentFiles[mergedID] = path
+	}
+	if len(merged) > 0 {
+		if err := syncDir(db.dirPath); err != nil {
+			return err
 		}
 	}
 
-	if len(segments) == 0 {
-		path := filepath.Join(db.dirPath, segmentPrefix+"0")
-		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	var ids []int
+	for id := range segmentFiles {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var segments []*segment
+	for _, id := range ids {
+		segment, err := initSegment(segmentFiles[id], id)
 		if err != nil {
 			return err
 		}
 
-		segments = append(segments, &segment{
-			filePath:  path,
-			file:      file,
-			outOffset: 0,
-			index:     make(hashIndex),
-		})
+		segments = append(segments, segment)
 	}
+
+	// The writes never go to a legacy segment, so that every file has
+	// records of one format.
+	if len(segments) == 0 || segments[len(segments)-1].legacy {
+		id := 0
+		if len(segments) > 0 {
+			id = segments[len(segments)-1].id + 1
+		}
+		segment, err := initSegment(db.segmentPath(id), id)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, segment)
+	}
+	countLive(segments)
 	db.segments = segments
-	return err
+	return nil
+}
+
+// segmentID parses the number of a segment file name. The legacy merged
+// segment comes before the numbered ones.
+func segmentID(name string) (int, bool) {
+	if name == legacyMerged {
+		return -1, true
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(name, segmentPrefix))
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+func (db *Db) segmentPath(id int) string {
+	if id < 0 {
+		return filepath.Join(db.dirPath, legacyMerged)
+	}
+	return filepath.Join(db.dirPath, fmt.Sprintf("%s%d", segmentPrefix, id))
+}
+
+// syncDir makes the renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
 }
 
+// Close waits for the write in progress, stops the merge in progress and
+// closes the segment files. The writes after Close fail with ErrClosed.
 func (db *Db) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.closing)
+	})
+	<-db.stopped
+	db.compaction.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	for _, seg := range db.segments {
 		err := seg.close()
 		if err != nil {
@@ -79,99 +331,338 @@ func (db *Db) Close() error {
 	return nil
 }
 
-func (db *Db) Get(key string) (string, error) {
+func (db *Db) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stats := Stats{
+		Segments:  len(db.segments),
+		Merges:    db.merges,
+		MergeTime: db.mergeTime,
+	}
+	stats.Garbage, stats.Bytes = garbage(db.segments)
+	return stats
+}
+
+// Verify reads all the segments through and returns their damaged
+// records, including the ones skipped when the Db was opened. The writes
+// wait for it to finish.
+func (db *Db) Verify() ([]Damage, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var damage []Damage
 	for _, seg := range db.segments {
-		value, err := seg.get(key)
-		if err == nil {
-			return value, err
+		segmentDamage, _, err := seg.scan(seg.outOffset, func(entry, position) {})
+		if err != nil {
+			return damage, err
 		}
+		damage = append(damage, segmentDamage...)
 	}
+	return damage, nil
+}
 
-	return "", fmt.Errorf("not found any value at the key: %s", key)
+// Get returns the latest value of key, looking through the segments from
+// the newest one.
+func (db *Db) Get(key string) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		value, err := db.segments[i].get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err == errDeleted {
+			return "", ErrNotFound
+		}
+		return value, err
+	}
+
+	return "", ErrNotFound
 }
 
 func (db *Db) Put(key, value string) error {
-	err := db.last().put(key, value)
-	if err != nil {
-		return err
+	return db.submit(entry{key: key, value: value})
+}
+
+// Delete writes a tombstone for key, so it is not found any longer. The
+// space the key takes is freed by the next merge.
+func (db *Db) Delete(key string) error {
+	return db.submit(entry{key: key, deleted: true})
+}
+
+// submit hands e to the writer and waits until it is written.
+func (db *Db) submit(e entry) error {
+	w := write{entry: e, done: make(chan error, 1)}
+	select {
+	case db.writes <- w:
+		return <-w.done
+	case <-db.closing:
+		return ErrClosed
 	}
+}
 
-	if db.last().outOffset >= db.segSize {
-		err := db.createSegment()
-		if err != nil {
-			return err
+// writer applies the writes and acknowledges them as the SyncPolicy says.
+// A group commit keeps the acknowledgements in pending until its batch is
+// synced, which happens on Close at the latest.
+func (db *Db) writer() {
+	defer close(db.stopped)
+	var (
+		pending []write
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	commit := func() {
+		err := db.syncLast()
+		for _, w := range pending {
+			w.done <- err
+		}
+		pending = nil
+		if timer != nil {
+			timer.Stop()
+			timeout = nil
+		}
+	}
+	for {
+		select {
+		case w := <-db.writes:
+			err := db.apply(w.entry)
+			switch {
+			case err != nil || db.durability.Mode == NoSync:
+				w.done <- err
+			case db.durability.Mode == SyncEveryWrite:
+				w.done <- db.syncLast()
+			default:
+				pending = append(pending, w)
+				if db.durability.Writes > 0 && len(pending) >= db.durability.Writes {
+					commit()
+				} else if timeout == nil {
+					timer = time.NewTimer(db.durability.Interval)
+					timeout = timer.C
+				}
+			}
+		case <-timeout:
+			timeout = nil
+			commit()
+		case <-db.closing:
+			if len(pending) > 0 {
+				commit()
+			}
+			return
 		}
 	}
-	return nil
 }
 
-func (db *Db) last() *segment {
-	return db.segments[len(db.segments)-1]
+// syncLast syncs the segment the writes go to. The ones before it are
+// synced when they are full.
+func (db *Db) syncLast() error {
+	db.mu.RLock()
+	last := db.last()
+	db.mu.RUnlock()
+	return last.file.Sync()
+}
+
+// apply writes e to the last segment, the writer calls it for every write.
+func (db *Db) apply(e entry) error {
+	if e.deleted {
+		if _, err := db.Get(e.key); err != nil {
+			return err
+		}
+	}
+	db.mu.Lock()
+	err := db.write(e)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.rotate()
 }
 
-func (db *Db) createSegment() error {
+// write appends e to the last segment and moves the live size of the key
+// to it. The caller holds the lock.
+func (db *Db) write(e entry) error {
+	var prev *segment
+	var pos position
+	for i := len(db.segments) - 1; i >= 0 && prev == nil; i-- {
+		if p, ok := db.segments[i].index[e.key]; ok {
+			prev, pos = db.segments[i], p
+		}
+	}
 	last := db.last()
+	if err := last.write(e); err != nil {
+		return err
+	}
+	if prev != nil && !pos.deleted {
+		prev.live -= pos.size
+	}
+	if !e.deleted {
+		last.live += last.index[e.key].size
+	}
+	return nil
+}
 
-	name := last.file.Name()
-	count, _ := strconv.Atoi(name[len(name)-1:])
-	path := filepath.Join(db.dirPath, fmt.Sprintf("%s%d", segmentPrefix, count+1))
+// rotate starts a new segment once the last one is full, and a merge of
+// the full ones if the policy asks for it and none is running.
+func (db *Db) rotate() error {
+	db.mu.RLock()
+	last := db.last()
+	db.mu.RUnlock()
+	if last.outOffset < db.segSize {
+		return nil
+	}
+	if db.durability.Mode != NoSync {
+		if err := last.file.Sync(); err != nil {
+			return err
+		}
+	}
 
-	seg, err := initSegment(path)
+	seg, err := initSegment(db.segmentPath(last.id+1), last.id+1)
 	if err != nil {
 		return err
 	}
+	if db.durability.Mode != NoSync {
+		if err := syncDir(db.dirPath); err != nil {
+			_ = seg.close()
+			return err
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	db.segments = append(db.segments, seg)
 
-	if len(db.segments) > 2 {
-		return db.merge()
+	full := db.segments[:len(db.segments)-1]
+	if !db.merging && db.policy.due(full) {
+		db.merging = true
+		db.compaction.Add(1)
+		go db.compact(append([]*segment(nil), full...))
 	}
-
 	return nil
 }
 
-func (db *Db) merge() error {
-	mergees := db.segments[0 : len(db.segments)-1]
-	newPath := filepath.Join(db.dirPath, segmentPrefix+"-merged")
+func (db *Db) last() *segment {
+	return db.segments[len(db.segments)-1]
+}
 
-	file, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE, 0o600)
-	if err != nil {
-		return err
+// compact merges the oldest segments, mergees, in the background. The
+// writes go on to the newer segments meanwhile.
+func (db *Db) compact(mergees []*segment) {
+	defer db.compaction.Done()
+	start := time.Now()
+	merged, err := db.merge(mergees)
+	if err == nil {
+		err = db.install(mergees, merged, start)
+	}
+	if err != nil && err != ErrClosed {
+		log.Printf("Segment merge failed: %s", err)
 	}
 
-	mergedSeg := &segment{
-		filePath:  newPath,
-		file:      file,
-		outOffset: 0,
-		index:     make(hashIndex),
+	db.mu.Lock()
+	db.merging = false
+	db.mu.Unlock()
+}
+
+// merge writes the latest entries of mergees to a segment numbered as the
+// newest of them and commits it, see mergedSuffix. Nothing else writes to
+// the mergees, so they are read without the lock.
+func (db *Db) merge(mergees []*segment) (*segment, error) {
+	id := mergees[len(mergees)-1].id
+	path := db.segmentPath(id) + mergingSuffix
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	mergedSeg, err := initSegment(path, id)
+	if err != nil {
+		return nil, err
+	}
+	abort := func(err error) (*segment, error) {
+		_ = mergedSeg.file.Close()
+		_ = os.Remove(path)
+		return nil, err
 	}
 
+	// The merged segments are the oldest ones, so a deleted key has no
+	// older values left to hide and its tombstone is dropped.
+	seen := make(map[string]bool)
 	for i := len(mergees) - 1; i >= 0; i-- {
 		mergee := mergees[i]
-		for key := range mergee.index {
-			if _, exists := mergedSeg.index[key]; exists {
+		for key, pos := range mergee.index {
+			if seen[key] {
 				continue
 			}
+			seen[key] = true
+			if pos.deleted {
+				continue
+			}
+			select {
+			case <-db.closing:
+				return abort(ErrClosed)
+			default:
+			}
 
 			value, err := mergee.get(key)
 			if err != nil {
-				_ = mergedSeg.close()
-				_ = os.Remove(newPath)
-				return err
+				return abort(err)
 			}
 
 			err = mergedSeg.put(key, value)
 			if err != nil {
-				_ = mergedSeg.close()
-				_ = os.Remove(newPath)
-				return err
+				return abort(err)
 			}
 		}
 	}
 
-	db.segments = []*segment{mergedSeg, db.last()}
+	if err := mergedSeg.file.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := os.Rename(path, db.segmentPath(id)+mergedSuffix); err != nil {
+		return abort(err)
+	}
+	mergedSeg.filePath = db.segmentPath(id) + mergedSuffix
+	return mergedSeg, syncDir(db.dirPath)
+}
+
+// install replaces mergees with the merged segment, keeping the segments
+// started during the merge, and then removes their files.
+func (db *Db) install(mergees []*segment, merged *segment, start time.Time) error {
+	db.mu.Lock()
+	newer := db.segments[len(mergees):]
+	for key, pos := range merged.index {
+		if !pos.deleted && !indexed(newer, key) {
+			merged.live += pos.size
+		}
+	}
+	db.segments = append([]*segment{merged}, newer...)
+	db.merges++
+	db.mergeTime += time.Since(start)
+	db.mu.Unlock()
+
+	// The reads that could use the mergees ended before the swap.
 	for _, segment := range mergees {
 		_ = segment.close()
-		_ = os.Remove(segment.filePath)
+		if err := os.Remove(segment.filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
-	return nil
+
+	// Readers open the segment files by path, so it changes under the lock.
+	db.mu.Lock()
+	path := db.segmentPath(merged.id)
+	err := os.Rename(merged.filePath, path)
+	if err == nil {
+		merged.filePath = path
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return syncDir(db.dirPath)
+}
+
+// indexed tells whether any of segments has an entry of key.
+func indexed(segments []*segment, key string) bool {
+	for _, seg := range segments {
+		if _, ok := seg.index[key]; ok {
+			return true
+		}
+	}
+	return false
 }
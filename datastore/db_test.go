@@ -1,11 +1,16 @@
 package datastore
 
 import (
+  "encoding/binary"
+  "fmt"
   "io/ioutil"
   "os"
   "path/filepath"
   "strings"
+  "sync"
+  "sync/atomic"
   "testing"
+  "time"
 )
 
 var testSize int64 = 256
@@ -67,7 +72,7 @@ func TestDb_Put(t *testing.T) {
     if err != nil {
       t.Fatal(err)
     }
-    if size1*2 != outInfo.Size() {
+    if (size1-headerSize)*2 != outInfo.Size()-headerSize {
       t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
     }
   })
@@ -118,7 +123,7 @@ func TestDb_Put(t *testing.T) {
     if err := db.Close(); err != nil {
       t.Fatal(err)
     }
-    db, err = NewDb(dir, 32)
+    db, err = NewDb(dir, 48)
     if err != nil {
       t.Fatal(err)
     }
@@ -128,6 +133,7 @@ func TestDb_Put(t *testing.T) {
       if err != nil {
         t.Errorf("Cannot put %s: %s", pairs[0], err)
       }
+      db.compaction.Wait()
       value, err := db.Get(pair[0])
       if err != nil {
         t.Errorf("Cannot get %s: %s", pairs[0], err)
@@ -137,15 +143,738 @@ func TestDb_Put(t *testing.T) {
       }
     }
 
-    if _, err = os.Open(filepath.Join(dir, segmentPrefix+"-merged")); err != nil {
-      t.Errorf("Cannot read segment file: %s", err)
+    // The full segment0 and segment1 merge into segment1, which merges
+    // with segment2 into segment2 once it is full too.
+    if err := db.Put(pairs[0][0], pairs[0][1]); err != nil {
+      t.Fatal(err)
+    }
+    db.compaction.Wait()
+    if db.merges != 2 {
+      t.Errorf("Unexpected number of merges %d", db.merges)
+    }
+    for _, name := range []string{"0", "1", "2.merged", "2.merging"} {
+      if _, err = os.Stat(filepath.Join(dir, segmentPrefix+name)); err == nil {
+        t.Errorf("Segment%s was not merged", name)
+      }
+    }
+    for _, name := range []string{"2", "3"} {
+      if _, err = os.Stat(filepath.Join(dir, segmentPrefix+name)); err != nil {
+        t.Errorf("Cannot read segment file: %s", err)
+      }
+    }
+
+    if err := db.Close(); err != nil {
+      t.Fatal(err)
+    }
+    db, err = NewDb(dir, 48)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, pair := range append(pairs, []string{"long", strings.Repeat("value", 30)}) {
+      if value, err := db.Get(pair[0]); err != nil || value != pair[1] {
+        t.Errorf("Got %q, %v for %s after merges", value, err, pair[0])
+      }
+    }
+  })
+
+}
+
+func TestDb_MergeRecovery(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  db, err := NewDb(dir, 32, Compaction(CompactionPolicy{}))
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 12; i++ {
+    if err := db.Put(fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := db.Delete("key0"); err != nil {
+    t.Fatal(err)
+  }
+  if db.merges != 0 || len(db.segments) < 4 {
+    t.Fatalf("Unexpected %d merges of %d segments", db.merges, len(db.segments))
+  }
+
+  // The process stops after the merge is committed, before the merged
+  // segments are removed, and leaves a merge in progress behind.
+  merged, err := db.merge(db.segments[:len(db.segments)-1])
+  if err != nil {
+    t.Fatal(err)
+  }
+  _ = merged.file.Close()
+  if err := db.Close(); err != nil {
+    t.Fatal(err)
+  }
+  leftover := filepath.Join(dir, segmentPrefix+"99"+mergingSuffix)
+  if err := ioutil.WriteFile(leftover, []byte("partial"), 0o600); err != nil {
+    t.Fatal(err)
+  }
+
+  db, err = NewDb(dir, 32, Compaction(CompactionPolicy{}))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  if len(db.segments) != 2 || db.segments[0].id != merged.id {
+    t.Errorf("Merge was not completed, %d segments", len(db.segments))
+  }
+  if _, err := os.Stat(leftover); err == nil {
+    t.Error("Unfinished merge was not removed")
+  }
+  if _, err := db.Get("key0"); err != ErrNotFound {
+    t.Errorf("Deleted key is found after recovery: %v", err)
+  }
+  for i := 8; i < 12; i++ {
+    if i%4 == 0 {
+      continue
+    }
+    key, want := fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i)
+    if value, err := db.Get(key); err != nil || value != want {
+      t.Errorf("Got %q, %v for %s instead of %s", value, err, key, want)
+    }
+  }
+}
+
+func TestDb_Delete(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  db, err := NewDb(dir, 64)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer func() { _ = db.Close() }()
+
+  t.Run("newest value", func(t *testing.T) {
+    for _, value := range []string{"value1", "value2", "value3", "value4", "value5"} {
+      if err := db.Put("key", value); err != nil {
+        t.Fatal(err)
+      }
+    }
+    db.compaction.Wait()
+    if len(db.segments) != 2 {
+      t.Fatalf("Unexpected number of segments %d", len(db.segments))
+    }
+    value, err := db.Get("key")
+    if err != nil || value != "value5" {
+      t.Errorf("Got %q, %v instead of the newest value", value, err)
+    }
+    if _, err := db.Get("missing"); err != ErrNotFound {
+      t.Errorf("Unexpected error for a missing key: %v", err)
+    }
+  })
+
+  t.Run("delete", func(t *testing.T) {
+    if err := db.Delete("key"); err != nil {
+      t.Fatal(err)
+    }
+    if _, err := db.Get("key"); err != ErrNotFound {
+      t.Errorf("Deleted key is still found: %v", err)
+    }
+    if err := db.Delete("key"); err != ErrNotFound {
+      t.Errorf("Unexpected error deleting a missing key: %v", err)
+    }
+
+    if err := db.Close(); err != nil {
+      t.Fatal(err)
+    }
+    db, err = NewDb(dir, 64)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if _, err := db.Get("key"); err != ErrNotFound {
+      t.Errorf("Deleted key is found after reopening: %v", err)
+    }
+  })
+
+  t.Run("merge drops deleted keys", func(t *testing.T) {
+    if err := db.Put("filler", strings.Repeat("x", 48)); err != nil {
+      t.Fatal(err)
+    }
+    db.compaction.Wait()
+    if db.merges != 1 {
+      t.Fatalf("Unexpected number of merges %d", db.merges)
+    }
+    if _, ok := db.segments[0].index["key"]; ok {
+      t.Error("Merged segment keeps the deleted key")
+    }
+    if _, err := db.Get("key"); err != ErrNotFound {
+      t.Errorf("Deleted key is found after merge: %v", err)
+    }
+    if err := db.Put("key", "again"); err != nil {
+      t.Fatal(err)
+    }
+    if value, err := db.Get("key"); err != nil || value != "again" {
+      t.Errorf("Got %q, %v after putting a deleted key again", value, err)
+    }
+  })
+}
+
+func TestDb_Corruption(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  db, err := NewDb(dir, testSize)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, key := range []string{"key1", "key2", "key3"} {
+    if err := db.Put(key, "value"); err != nil {
+      t.Fatal(err)
     }
-    if _, err = os.Open(filepath.Join(dir, segmentPrefix+"1")); err == nil {
-      t.Errorf("Segment was not merged!: %s", err)
+  }
+  if err := db.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  // Every record takes 25 bytes after the header. The value of key2 gets
+  // a flipped bit and the process stops in the middle of a write.
+  path := filepath.Join(dir, segmentPrefix+"0")
+  data, err := ioutil.ReadFile(path)
+  if err != nil || len(data) != 83 {
+    t.Fatalf("Unexpected segment of %d bytes: %v", len(data), err)
+  }
+  data[8+25+20] ^= 1
+  torn := entry{key: "key4", value: "value"}
+  data = append(data, torn.Encode()[:10]...)
+  if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+    t.Fatal(err)
+  }
+
+  db, err = NewDb(dir, testSize)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer func() { _ = db.Close() }()
+
+  t.Run("recover", func(t *testing.T) {
+    if info, err := os.Stat(path); err != nil || info.Size() != 83 {
+      t.Errorf("Torn write was not cut off: %v", err)
+    }
+    if _, err := db.Get("key2"); err != ErrNotFound {
+      t.Errorf("Corrupt record is found: %v", err)
+    }
+    for _, key := range []string{"key1", "key3"} {
+      if value, err := db.Get(key); err != nil || value != "value" {
+        t.Errorf("Got %q, %v for %s", value, err, key)
+      }
+    }
+    if err := db.Put("key4", "value"); err != nil {
+      t.Fatal(err)
     }
-    if _, err = os.Open(filepath.Join(dir, segmentPrefix+"2")); err != nil {
-      t.Errorf("Cannot read segment file: %s", err)
+    if value, err := db.Get("key4"); err != nil || value != "value" {
+      t.Errorf("Got %q, %v after the torn write", value, err)
     }
   })
 
-}
\ No newline at end of file
+  t.Run("verify", func(t *testing.T) {
+    damage, err := db.Verify()
+    if err != nil {
+      t.Fatal(err)
+    }
+    want := []Damage{{Segment: segmentPrefix + "0", Offset: 33, Err: ErrCorrupt}}
+    if len(damage) != 1 || damage[0] != want[0] {
+      t.Errorf("Got damage %v instead of %v", damage, want)
+    }
+  })
+
+  t.Run("quarantine", func(t *testing.T) {
+    if err := db.Close(); err != nil {
+      t.Fatal(err)
+    }
+    junk := []byte{3, 0, 0, 0, 'j', 'u', 'n', 'k'}
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, err = file.Write(junk)
+    _ = file.Close()
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    db, err = NewDb(dir, testSize)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if info, err := os.Stat(path); err != nil || info.Size() != 108 {
+      t.Errorf("Unreadable tail was not cut off: %v", err)
+    }
+    if kept, err := ioutil.ReadFile(path + corruptSuffix); err != nil || string(kept) != string(junk) {
+      t.Errorf("Unreadable tail was not kept aside: %q, %v", kept, err)
+    }
+    if value, err := db.Get("key4"); err != nil || value != "value" {
+      t.Errorf("Got %q, %v for key4", value, err)
+    }
+  })
+}
+
+func TestDb_ResyncLarge(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  // The records after the damaged ones are longer than the chunks resync
+  // reads the file in.
+  big := strings.Repeat("v", 2*resyncBufSize)
+  db, err := NewDb(dir, 1<<20)
+  if err != nil {
+    t.Fatal(err)
+  }
+  pairs := [][]string{{"key1", "value"}, {"big1", big}, {"big2", big}, {"key2", "value"}}
+  var offsets []int
+  offset := int(headerSize)
+  for _, pair := range pairs {
+    if err := db.Put(pair[0], pair[1]); err != nil {
+      t.Fatal(err)
+    }
+    offsets = append(offsets, offset)
+    offset += len(pair[0]) + len(pair[1]) + 16
+  }
+  if err := db.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  path := filepath.Join(dir, segmentPrefix+"0")
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data[offsets[0]+20] ^= 1
+  data[offsets[2]+20] ^= 1
+  if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+    t.Fatal(err)
+  }
+
+  db, err = NewDb(dir, 1<<20)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  for _, key := range []string{"key1", "big2"} {
+    if _, err := db.Get(key); err != ErrNotFound {
+      t.Errorf("Corrupt record of %s is found: %v", key, err)
+    }
+  }
+  if value, err := db.Get("big1"); err != nil || value != big {
+    t.Errorf("Got %d bytes, %v for big1", len(value), err)
+  }
+  if value, err := db.Get("key2"); err != nil || value != "value" {
+    t.Errorf("Got %q, %v for key2", value, err)
+  }
+  damage, err := db.Verify()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(damage) != 2 || damage[0].Offset != int64(offsets[0]) || damage[1].Offset != int64(offsets[2]) {
+    t.Errorf("Got damage %v at offsets %v", damage, offsets)
+  }
+}
+
+var syncPolicies = []struct {
+  name   string
+  policy SyncPolicy
+}{
+  {"none", SyncPolicy{Mode: NoSync}},
+  {"every-write", SyncPolicy{Mode: SyncEveryWrite}},
+  {"group", SyncPolicy{Mode: GroupCommit, Interval: time.Millisecond, Writes: 16}},
+}
+
+func TestDb_Durability(t *testing.T) {
+  for _, tc := range syncPolicies {
+    t.Run(tc.name, func(t *testing.T) {
+      dir, err := ioutil.TempDir("", "test-db")
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer os.RemoveAll(dir)
+
+      db, err := NewDb(dir, 256, Durability(tc.policy))
+      if err != nil {
+        t.Fatal(err)
+      }
+      var wg sync.WaitGroup
+      for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func(w int) {
+          defer wg.Done()
+          for i := 0; i < 50; i++ {
+            if err := db.Put(fmt.Sprintf("key%d-%d", w, i), "value"); err != nil {
+              t.Errorf("Cannot put: %s", err)
+              return
+            }
+          }
+        }(w)
+      }
+      wg.Wait()
+      if err := db.Close(); err != nil {
+        t.Fatal(err)
+      }
+
+      db, err = NewDb(dir, 256, Durability(tc.policy))
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer db.Close()
+      for w := 0; w < 4; w++ {
+        for i := 0; i < 50; i++ {
+          if _, err := db.Get(fmt.Sprintf("key%d-%d", w, i)); err != nil {
+            t.Errorf("Cannot get key%d-%d: %s", w, i, err)
+          }
+        }
+      }
+    })
+  }
+
+  t.Run("group commit", func(t *testing.T) {
+    dir, err := ioutil.TempDir("", "test-db")
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    db, err := NewDb(dir, testSize, Durability(SyncPolicy{Mode: GroupCommit, Interval: 50 * time.Millisecond, Writes: 4}))
+    if err != nil {
+      t.Fatal(err)
+    }
+    start := time.Now()
+    if err := db.Put("key", "value"); err != nil {
+      t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+      t.Errorf("Write was acknowledged before its batch was synced, in %s", elapsed)
+    }
+
+    // A full batch is synced at once.
+    start = time.Now()
+    var wg sync.WaitGroup
+    for w := 0; w < 4; w++ {
+      wg.Add(1)
+      go func(w int) {
+        defer wg.Done()
+        if err := db.Put(fmt.Sprintf("key%d", w), "value"); err != nil {
+          t.Errorf("Cannot put: %s", err)
+        }
+      }(w)
+    }
+    wg.Wait()
+    if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+      t.Errorf("Full batch waited for %s", elapsed)
+    }
+
+    // Close syncs the batch in progress.
+    if err := db.Close(); err != nil {
+      t.Fatal(err)
+    }
+    db, err = NewDb(dir, testSize, Durability(SyncPolicy{Mode: GroupCommit, Interval: time.Hour}))
+    if err != nil {
+      t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() { done <- db.Put("last", "value") }()
+    for {
+      if _, err := db.Get("last"); err == nil {
+        break
+      }
+      time.Sleep(time.Millisecond)
+    }
+    if err := db.Close(); err != nil {
+      t.Fatal(err)
+    }
+    if err := <-done; err != nil {
+      t.Errorf("Write in the closed batch failed: %s", err)
+    }
+  })
+}
+
+func BenchmarkDb_Put(b *testing.B) {
+  for _, tc := range syncPolicies {
+    b.Run(tc.name, func(b *testing.B) {
+      dir, err := ioutil.TempDir("", "bench-db")
+      if err != nil {
+        b.Fatal(err)
+      }
+      defer os.RemoveAll(dir)
+
+      db, err := NewDb(dir, DefaultSegmentSize, Durability(tc.policy))
+      if err != nil {
+        b.Fatal(err)
+      }
+      defer db.Close()
+
+      var n int64
+      b.SetParallelism(16)
+      b.ResetTimer()
+      b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+          key := fmt.Sprintf("key%d", atomic.AddInt64(&n, 1)%1000)
+          if err := db.Put(key, "value"); err != nil {
+            b.Error(err)
+            return
+          }
+        }
+      })
+    })
+  }
+}
+
+func TestDb_CorruptSize(t *testing.T) {
+  for name, size := range map[string]uint32{
+    "past the end": 1 << 16,
+    "into the next": 26,
+    "too small":    4,
+  } {
+    t.Run(name, func(t *testing.T) {
+      dir, err := ioutil.TempDir("", "test-db")
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer os.RemoveAll(dir)
+
+      db, err := NewDb(dir, testSize)
+      if err != nil {
+        t.Fatal(err)
+      }
+      for _, key := range []string{"k1", "k2", "k3", "k4"} {
+        if err := db.Put(key, "value"); err != nil {
+          t.Fatal(err)
+        }
+      }
+      if err := db.Close(); err != nil {
+        t.Fatal(err)
+      }
+
+      // Every record takes 23 bytes after the header, the size of k2 is
+      // damaged.
+      path := filepath.Join(dir, segmentPrefix+"0")
+      data, err := ioutil.ReadFile(path)
+      if err != nil || len(data) != 8+4*23 {
+        t.Fatalf("Unexpected segment of %d bytes: %v", len(data), err)
+      }
+      binary.LittleEndian.PutUint32(data[8+23:], size)
+      if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+        t.Fatal(err)
+      }
+
+      db, err = NewDb(dir, testSize)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer db.Close()
+      if info, err := os.Stat(path); err != nil || info.Size() != int64(len(data)) {
+        t.Errorf("Segment was cut off: %v", err)
+      }
+      if _, err := db.Get("k2"); err != ErrNotFound {
+        t.Errorf("Damaged record is found: %v", err)
+      }
+      for _, key := range []string{"k1", "k3", "k4"} {
+        if value, err := db.Get(key); err != nil || value != "value" {
+          t.Errorf("Got %q, %v for %s", value, err, key)
+        }
+      }
+      damage, err := db.Verify()
+      want := Damage{Segment: segmentPrefix + "0", Offset: 8 + 23, Err: ErrCorrupt}
+      if err != nil || len(damage) != 1 || damage[0] != want {
+        t.Errorf("Got damage %v, %v instead of %v", damage, err, want)
+      }
+    })
+  }
+}
+
+func TestDb_Legacy(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  // A segment of the older versions: no header and records without
+  // checksums.
+  var data []byte
+  for _, key := range []string{"key1", "key2"} {
+    e := entry{key: key, value: "value"}
+    record := e.Encode()
+    record = record[:len(record)-4]
+    record[0] -= 4
+    data = append(data, record...)
+  }
+  path := filepath.Join(dir, segmentPrefix+"0")
+  if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+    t.Fatal(err)
+  }
+
+  db, err := NewDb(dir, testSize)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  if len(db.segments) != 2 || !db.segments[0].legacy || db.segments[1].legacy {
+    t.Fatalf("Writes go to the legacy segment")
+  }
+  if err := db.Put("key2", "new"); err != nil {
+    t.Fatal(err)
+  }
+  if value, err := db.Get("key1"); err != nil || value != "value" {
+    t.Errorf("Got %q, %v from the legacy segment", value, err)
+  }
+  if value, err := db.Get("key2"); err != nil || value != "new" {
+    t.Errorf("Got %q, %v instead of the new value", value, err)
+  }
+  if kept, err := ioutil.ReadFile(path); err != nil || string(kept) != string(data) {
+    t.Errorf("Legacy segment changed: %v", err)
+  }
+}
+
+func TestDb_Concurrent(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  db, err := NewDb(dir, 256)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  const writers, readers, rounds = 8, 8, 1000
+  var wg sync.WaitGroup
+  for w := 0; w < writers; w++ {
+    wg.Add(1)
+    go func(w int) {
+      defer wg.Done()
+      for i := 0; i < rounds; i++ {
+        key := fmt.Sprintf("key%d-%d", w, i%10)
+        if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+          t.Errorf("Cannot put %s: %s", key, err)
+          return
+        }
+        if i%7 == 0 {
+          if err := db.Delete(key); err != nil {
+            t.Errorf("Cannot delete %s: %s", key, err)
+            return
+          }
+        }
+      }
+    }(w)
+  }
+  for r := 0; r < readers; r++ {
+    wg.Add(1)
+    go func(r int) {
+      defer wg.Done()
+      for i := 0; i < rounds; i++ {
+        key := fmt.Sprintf("key%d-%d", r%writers, i%10)
+        if value, err := db.Get(key); err != nil && err != ErrNotFound {
+          t.Errorf("Cannot get %s: %s", key, err)
+          return
+        } else if err == nil && !strings.HasPrefix(value, "value") {
+          t.Errorf("Bad value of %s: %q", key, value)
+          return
+        }
+        _ = db.Stats()
+      }
+    }(r)
+  }
+  wg.Wait()
+  db.compaction.Wait()
+  if stats := db.Stats(); stats.Merges < 2 {
+    t.Errorf("Writes merged segments only %d times", stats.Merges)
+  }
+
+  check := func() {
+    for w := 0; w < writers; w++ {
+      for i := rounds - 10; i < rounds; i++ {
+        key := fmt.Sprintf("key%d-%d", w, i%10)
+        value, err := db.Get(key)
+        if i%7 == 0 {
+          if err != ErrNotFound {
+            t.Errorf("Deleted %s is found: %q, %v", key, value, err)
+          }
+        } else if want := fmt.Sprintf("value%d", i); err != nil || value != want {
+          t.Errorf("Got %q, %v for %s instead of %s", value, err, key, want)
+        }
+      }
+    }
+  }
+  check()
+  stats := db.Stats()
+
+  if err := db.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Put("key", "value"); err != ErrClosed {
+    t.Errorf("Unexpected error writing to a closed database: %v", err)
+  }
+
+  db, err = NewDb(dir, 256)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  check()
+  if reopened := db.Stats(); reopened.Garbage != stats.Garbage || reopened.Bytes != stats.Bytes {
+    t.Errorf("Kept %d of %d bytes garbage, counted %d of %d on reopening",
+      stats.Garbage, stats.Bytes, reopened.Garbage, reopened.Bytes)
+  }
+}
+
+func TestDb_Stats(t *testing.T) {
+  dir, err := ioutil.TempDir("", "test-db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  db, err := NewDb(dir, testSize, Compaction(CompactionPolicy{}))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  size := func(key, value string) int64 {
+    return int64(len((&entry{key: key, value: value}).Encode()))
+  }
+  if err := db.Put("key1", "value1"); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Put("key1", "value11"); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Put("key2", "value2"); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Delete("key2"); err != nil {
+    t.Fatal(err)
+  }
+  tombstone := int64(len((&entry{key: "key2", deleted: true}).Encode()))
+  garbage := size("key1", "value1") + size("key2", "value2") + tombstone
+  if stats := db.Stats(); stats.Garbage != garbage {
+    t.Errorf("Counted %d bytes of garbage instead of %d", stats.Garbage, garbage)
+  }
+
+  if err := db.Close(); err != nil {
+    t.Fatal(err)
+  }
+  db, err = NewDb(dir, testSize, Compaction(CompactionPolicy{}))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  if stats := db.Stats(); stats.Garbage != garbage {
+    t.Errorf("Counted %d bytes of garbage on reopening instead of %d", stats.Garbage, garbage)
+  }
+}
@@ -3,23 +3,48 @@ package datastore
 import (
   "bufio"
   "encoding/binary"
-  "fmt"
+  "errors"
+  "hash/crc32"
+  "io"
+  "math"
 )
 
+// tombstone is written in place of the value length of a deleted key, such
+// entries have no value bytes.
+const tombstone = math.MaxUint32
+
+// errDeleted is returned when the latest entry of a key is a tombstone.
+var errDeleted = errors.New("record is deleted")
+
+// minRecordSize is the size of a record with an empty key and value and
+// no checksum.
+const minRecordSize = 12
+
 type entry struct {
   key, value string
+  deleted    bool
 }
 
+// Encode returns the record of the entry: its size, the key length, the
+// key, the value length, the value and the CRC32 of all of them.
 func (e *entry) Encode() []byte {
   kl := len(e.key)
   vl := len(e.value)
-  size := kl + vl + 12
+  if e.deleted {
+    vl = 0
+  }
+  size := kl + vl + 16
   res := make([]byte, size)
   binary.LittleEndian.PutUint32(res, uint32(size))
   binary.LittleEndian.PutUint32(res[4:], uint32(kl))
   copy(res[8:], e.key)
-  binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-  copy(res[kl+12:], e.value)
+  if e.deleted {
+    binary.LittleEndian.PutUint32(res[kl+8:], tombstone)
+  } else {
+    binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+    copy(res[kl+12:], e.value)
+  }
+  binary.LittleEndian.PutUint32(res[size-4:], crc32.ChecksumIEEE(res[:size-4]))
   return res
 }
 
@@ -30,40 +55,72 @@ func (e *entry) Decode(input []byte) {
   e.key = string(keyBuf)
 
   vl := binary.LittleEndian.Uint32(input[kl+8:])
+  if vl == tombstone {
+    e.value, e.deleted = "", true
+    return
+  }
+  e.deleted = false
   valBuf := make([]byte, vl)
   copy(valBuf, input[kl+12:kl+12+vl])
   e.value = string(valBuf)
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-  header, err := in.Peek(8)
-  if err != nil {
-    return "", err
+// decodeRecord checks a whole record and decodes it. The records of the
+// legacy segments, written before the checksums were added, have none.
+func decodeRecord(data []byte, legacy bool) (entry, error) {
+  var e entry
+  size := uint64(len(data))
+  if size < minRecordSize || uint64(binary.LittleEndian.Uint32(data)) != size {
+    return e, ErrCorrupt
   }
-  keySize := int(binary.LittleEndian.Uint32(header[4:]))
-  _, err = in.Discard(keySize + 8)
-  if err != nil {
-    return "", err
+  kl := uint64(binary.LittleEndian.Uint32(data[4:]))
+  if kl+12 > size {
+    return e, ErrCorrupt
+  }
+  body := kl + 12
+  if vl := binary.LittleEndian.Uint32(data[kl+8:]); vl != tombstone {
+    body += uint64(vl)
   }
+  if legacy {
+    if size != body {
+      return e, ErrCorrupt
+    }
+  } else if size != body+4 || crc32.ChecksumIEEE(data[:body]) != binary.LittleEndian.Uint32(data[body:]) {
+    return e, ErrCorrupt
+  }
+  e.Decode(data)
+  return e, nil
+}
 
-  header, err = in.Peek(4)
+// readRecord reads the record in starts with.
+func readRecord(in *bufio.Reader) ([]byte, error) {
+  header, err := in.Peek(4)
   if err != nil {
-    return "", err
+    return nil, err
+  }
+  size := binary.LittleEndian.Uint32(header)
+  if size < minRecordSize {
+    return nil, ErrCorrupt
+  }
+  data := make([]byte, size)
+  _, err = io.ReadFull(in, data)
+  return data, err
+}
+
+func readValue(in *bufio.Reader, legacy bool) (string, error) {
+  data, err := readRecord(in)
+  if err == io.ErrUnexpectedEOF {
+    return "", ErrCorrupt
   }
-  valSize := int(binary.LittleEndian.Uint32(header))
-  _, err = in.Discard(4)
   if err != nil {
     return "", err
   }
-
-  data := make([]byte, valSize)
-  n, err := in.Read(data)
+  e, err := decodeRecord(data, legacy)
   if err != nil {
     return "", err
   }
-  if n != valSize {
-    return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+  if e.deleted {
+    return "", errDeleted
   }
-
-  return string(data), nil
-}
\ No newline at end of file
+  return e.value, nil
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-  e := entry{"key", "value"}
+  e := entry{key: "key", value: "value"}
   e.Decode(e.Encode())
   if e.key != "key" {
     t.Error("incorrect key")
@@ -18,13 +18,60 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-  e := entry{"key", "test-value"}
+  e := entry{key: "key", value: "test-value"}
   data := e.Encode()
-  v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+  v, err := readValue(bufio.NewReader(bytes.NewReader(data)), false)
   if err != nil {
     t.Fatal(err)
   }
   if v != "test-value" {
     t.Errorf("Got bat value [%s]", v)
   }
-}
\ No newline at end of file
+}
+
+func TestEntry_Tombstone(t *testing.T) {
+  e := entry{key: "key", deleted: true}
+  data := e.Encode()
+  if len(data) != 19 {
+    t.Errorf("Unexpected tombstone size %d", len(data))
+  }
+  var decoded entry
+  decoded.Decode(data)
+  if decoded.key != "key" || !decoded.deleted {
+    t.Errorf("Unexpected entry %+v", decoded)
+  }
+  if _, err := readValue(bufio.NewReader(bytes.NewReader(data)), false); err != errDeleted {
+    t.Errorf("Unexpected error %v", err)
+  }
+}
+
+func TestEntry_Checksum(t *testing.T) {
+  e := entry{key: "key", value: "value"}
+  data := e.Encode()
+  if decoded, err := decodeRecord(data, false); err != nil || decoded != e {
+    t.Errorf("Got %+v, %v for an intact record", decoded, err)
+  }
+  for _, i := range []int{4, 9, 13, len(data) - 1} {
+    damaged := append([]byte(nil), data...)
+    damaged[i] ^= 1
+    if _, err := decodeRecord(damaged, false); err != ErrCorrupt {
+      t.Errorf("Damage at %d is not detected: %v", i, err)
+    }
+  }
+
+  // The checksum doesn't pass for a part of a longer value.
+  longer := append([]byte(nil), data...)
+  longer[11] += 4
+  if _, err := decodeRecord(longer, false); err != ErrCorrupt {
+    t.Errorf("Value taking the checksum is not detected: %v", err)
+  }
+
+  legacy := append([]byte(nil), data[:len(data)-4]...)
+  legacy[0] -= 4
+  if decoded, err := decodeRecord(legacy, true); err != nil || decoded != e {
+    t.Errorf("Got %+v, %v for a legacy record", decoded, err)
+  }
+  if _, err := decodeRecord(legacy, false); err != ErrCorrupt {
+    t.Errorf("Record without checksum is taken: %v", err)
+  }
+}
@@ -2,29 +2,55 @@ package datastore
 
 import (
   "bufio"
+  "bytes"
   "encoding/binary"
-  "fmt"
   "io"
+  "log"
   "os"
+  "path/filepath"
 )
 
-type hashIndex map[string]int64
+// position locates the latest entry of a key in a segment.
+type position struct {
+  offset, size int64
+  deleted      bool
+}
+
+type hashIndex map[string]position
 
 type segment struct {
+  id        int
   filePath  string
   file      *os.File
   outOffset int64
   index     hashIndex
+  // legacy segments have no header and no checksums, they are only read.
+  legacy bool
+  // live is the size of the records holding the latest value of their key
+  // in the database, the db keeps it up to date under its lock.
+  live int64
 }
 
 const bufSize = 8192
 
-func initSegment(path string) (*segment, error) {
+// segmentMagic is the header of the segment files whose records have
+// checksums. It reads as a record of size zero, so no legacy file starts
+// with it.
+var segmentMagic = []byte{0, 0, 0, 0, 'k', 'v', 'c', '1'}
+
+const headerSize = int64(8)
+
+// corruptSuffix is added to the name of the file keeping the unreadable
+// part cut off a segment.
+const corruptSuffix = ".corrupt"
+
+func initSegment(path string, id int) (*segment, error) {
   file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
   if err != nil {
     return nil, err
   }
   seg := &segment{
+    id:        id,
     filePath:  path,
     file:      file,
     outOffset: 0,
@@ -32,7 +58,8 @@ func initSegment(path string) (*segment, error) {
   }
 
   err = seg.recover()
-  if err != nil && err != io.EOF {
+  if err != nil {
+    _ = file.Close()
     return nil, err
   }
 
@@ -40,6 +67,10 @@ func initSegment(path string) (*segment, error) {
 }
 
 func (seg *segment) close() error {
+  if err := seg.file.Sync(); err != nil {
+    _ = seg.file.Close()
+    return err
+  }
   return seg.file.Close()
 }
 
@@ -55,74 +86,299 @@ func (seg *segment) get(key string) (string, error) {
   }
   defer file.Close()
 
-  _, err = file.Seek(position, 0)
+  _, err = file.Seek(position.offset, 0)
   if err != nil {
     return "", err
   }
 
   reader := bufio.NewReader(file)
-  value, err := readValue(reader)
+  value, err := readValue(reader, seg.legacy)
   if err != nil {
-    return "", nil
+    return "", err
   }
 
   return value, nil
 }
 
+// start is the offset of the first record.
+func (seg *segment) start() int64 {
+  if seg.legacy {
+    return 0
+  }
+  return headerSize
+}
+
 func (seg *segment) put(key, value string) error {
-  e := entry{
+  return seg.write(entry{
     key:   key,
     value: value,
-  }
+  })
+}
+
+func (seg *segment) write(e entry) error {
+  key := e.key
   n, err := seg.file.Write(e.Encode())
   if err == nil {
-    seg.index[key] = seg.outOffset
+    seg.index[key] = position{offset: seg.outOffset, size: int64(n), deleted: e.deleted}
     seg.outOffset += int64(n)
   }
   return err
 }
 
+// garbage returns the bytes of segments taken by entries that a merge
+// would drop: the overwritten ones and the deletions.
+func garbage(segments []*segment) (garbage, total int64) {
+  for _, seg := range segments {
+    total += seg.outOffset
+    garbage += seg.outOffset - seg.start() - seg.live
+  }
+  return garbage, total
+}
+
+// countLive sets the live size of segments, ordered from the oldest.
+func countLive(segments []*segment) {
+  seen := make(map[string]bool)
+  for i := len(segments) - 1; i >= 0; i-- {
+    segments[i].live = 0
+    for key, pos := range segments[i].index {
+      if seen[key] {
+        continue
+      }
+      seen[key] = true
+      if !pos.deleted {
+        segments[i].live += pos.size
+      }
+    }
+  }
+}
+
+// recover indexes the intact records of the segment file. A new file gets
+// the header, a file without it is a legacy one. The damaged records are
+// skipped. A torn write at the tail is cut off, as is any other unreadable
+// tail, which is kept aside in a file with corruptSuffix.
 func (seg *segment) recover() error {
-  input, err := os.Open(seg.filePath)
+  info, err := seg.file.Stat()
   if err != nil {
     return err
   }
-  defer input.Close()
+  head := make([]byte, headerSize)
+  n, err := readAt(seg.filePath, head, 0)
+  if err != nil {
+    return err
+  }
+  if n < len(head) && bytes.Equal(head[:n], segmentMagic[:n]) {
+    // The file is new or the process stopped while writing the header.
+    if err := seg.file.Truncate(0); err != nil {
+      return err
+    }
+    if _, err := seg.file.Write(segmentMagic); err != nil {
+      return err
+    }
+    seg.outOffset = headerSize
+    return nil
+  }
+  seg.legacy = !bytes.Equal(head, segmentMagic)
 
-  var buf [bufSize]byte
-  in := bufio.NewReaderSize(input, bufSize)
-  for err == nil {
-    var (
-      header, data []byte
-      n            int
-    )
-    header, err = in.Peek(bufSize)
-    if err == io.EOF {
-      if len(header) == 0 {
+  damage, end, err := seg.scan(info.Size(), func(e entry, pos position) {
+    seg.index[e.key] = pos
+  })
+  if err != nil {
+    return err
+  }
+  for _, d := range damage {
+    log.Printf("Segment %s is damaged at %d: %s", d.Segment, d.Offset, d.Err)
+  }
+  if end < info.Size() {
+    if damage[len(damage)-1].Err != ErrTornWrite {
+      if err := seg.quarantine(end); err != nil {
         return err
       }
-    } else if err != nil {
+    }
+    if err := seg.file.Truncate(end); err != nil {
       return err
     }
-    size := binary.LittleEndian.Uint32(header)
+  }
+  seg.outOffset = end
+  return nil
+}
+
+// scan reads the records of the first size bytes of the segment file and
+// passes the intact ones to visit. After a damaged record it goes on from
+// the next one that passes its checksum. It returns the damaged records
+// and the offset where the readable ones end: a tail with no intact record
+// in it is a torn write if it starts with a part of a record, and corrupt
+// otherwise.
+func (seg *segment) scan(size int64, visit func(e entry, pos position)) ([]Damage, int64, error) {
+  input, err := os.Open(seg.filePath)
+  if err != nil {
+    return nil, 0, err
+  }
+  defer input.Close()
 
-    if size < bufSize {
-      data = buf[:size]
-    } else {
-      data = make([]byte, size)
+  var damage []Damage
+  offset := seg.start()
+  in := bufio.NewReaderSize(io.NewSectionReader(input, offset, size-offset), bufSize)
+  for offset < size {
+    header, err := in.Peek(4)
+    if err != nil && err != io.EOF {
+      return damage, offset, err
+    }
+    var recordSize int64
+    if len(header) == 4 {
+      recordSize = int64(binary.LittleEndian.Uint32(header))
+    }
+    if recordSize >= minRecordSize && offset+recordSize <= size {
+      data, err := readRecord(in)
+      if err != nil {
+        return damage, offset, err
+      }
+      if e, err := decodeRecord(data, seg.legacy); err == nil {
+        visit(e, position{offset: offset, size: recordSize, deleted: e.deleted})
+        offset += recordSize
+        continue
+      }
     }
-    n, err = in.Read(data)
 
-    if err == nil {
-      if n != int(size) {
-        return fmt.Errorf("corrupted file")
+    next, err := seg.resync(input, offset+1, size)
+    if err != nil {
+      return damage, offset, err
+    }
+    if next < 0 {
+      if len(header) < 4 || recordSize >= minRecordSize && offset+recordSize > size {
+        return append(damage, seg.damage(offset, ErrTornWrite)), offset, nil
       }
+      return append(damage, seg.damage(offset, ErrCorrupt)), offset, nil
+    }
+    damage = append(damage, seg.damage(offset, ErrCorrupt))
+    offset = next
+    in.Reset(io.NewSectionReader(input, offset, size-offset))
+  }
+  return damage, offset, nil
+}
+
+// resyncBufSize is the size of the chunks resync reads the file in.
+const resyncBufSize = 64 << 10
 
-      var e entry
-      e.Decode(data)
-      seg.index[e.key] = seg.outOffset
-      seg.outOffset += int64(n)
+// resync returns the offset of the first record from offset on that passes
+// its checksum, or -1 if there is none. The records of legacy segments have
+// no checksums to tell them from garbage, so it doesn't look for them.
+func (seg *segment) resync(input *os.File, offset, size int64) (int64, error) {
+  if seg.legacy {
+    return -1, nil
+  }
+  // buf holds n bytes of the file from base on. The bytes too few to make
+  // a record at the end of a chunk are carried over to the next one.
+  buf := make([]byte, resyncBufSize)
+  base, n := offset, 0
+  for base+minRecordSize <= size {
+    want := size - base - int64(n)
+    if free := int64(len(buf) - n); want > free {
+      want = free
+    }
+    m, err := input.ReadAt(buf[n:n+int(want)], base+int64(n))
+    if err != nil && err != io.EOF {
+      return -1, err
+    }
+    n += m
+    i := 0
+    for ; i+minRecordSize <= n; i++ {
+      at := base + int64(i)
+      recordSize := int64(binary.LittleEndian.Uint32(buf[i:]))
+      if recordSize < minRecordSize || at+recordSize > size {
+        continue
+      }
+      ok, err := checkRecord(input, buf[i:n], at, recordSize)
+      if err != nil {
+        return -1, err
+      }
+      if ok {
+        return at, nil
+      }
     }
+    if m == 0 {
+      break
+    }
+    n = copy(buf, buf[i:n])
+    base += int64(i)
   }
-  return err
-}
\ No newline at end of file
+  return -1, nil
+}
+
+// checkRecord tells whether the record of size bytes at offset of the
+// file, which starts with head, passes its checksum. A record reaching past
+// head is read only if its lengths add up.
+func checkRecord(input *os.File, head []byte, offset, size int64) (bool, error) {
+  if int64(len(head)) >= size {
+    _, err := decodeRecord(head[:size], false)
+    return err == nil, nil
+  }
+  kl := int64(binary.LittleEndian.Uint32(head[4:]))
+  if kl+16 > size {
+    return false, nil
+  }
+  vlField := make([]byte, 4)
+  if kl+12 <= int64(len(head)) {
+    copy(vlField, head[kl+8:])
+  } else if _, err := input.ReadAt(vlField, offset+kl+8); err != nil {
+    return false, err
+  }
+  body := kl + 12
+  if vl := binary.LittleEndian.Uint32(vlField); vl != tombstone {
+    body += int64(vl)
+  }
+  if body+4 != size {
+    return false, nil
+  }
+  data := make([]byte, size)
+  if _, err := input.ReadAt(data, offset); err != nil {
+    return false, err
+  }
+  _, err := decodeRecord(data, false)
+  return err == nil, nil
+}
+
+// readAt reads the file at path from offset on into buf, as much as there
+// is.
+func readAt(path string, buf []byte, offset int64) (int, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return 0, err
+  }
+  defer file.Close()
+  n, err := file.ReadAt(buf, offset)
+  if err == io.EOF {
+    err = nil
+  }
+  return n, err
+}
+
+func (seg *segment) damage(offset int64, err error) Damage {
+  return Damage{Segment: filepath.Base(seg.filePath), Offset: offset, Err: err}
+}
+
+// quarantine copies the segment file from offset on to a file with
+// corruptSuffix.
+func (seg *segment) quarantine(offset int64) error {
+  input, err := os.Open(seg.filePath)
+  if err != nil {
+    return err
+  }
+  defer input.Close()
+  if _, err := input.Seek(offset, io.SeekStart); err != nil {
+    return err
+  }
+
+  out, err := os.OpenFile(seg.filePath+corruptSuffix, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+  if err != nil {
+    return err
+  }
+  if _, err := io.Copy(out, input); err != nil {
+    _ = out.Close()
+    return err
+  }
+  if err := out.Sync(); err != nil {
+    _ = out.Close()
+    return err
+  }
+  return out.Close()
+}
@@ -3,6 +3,7 @@ module github.com/gogaeva/balancer
 go 1.15
 
 require (
-  github.com/kr/text v0.2.0 // indirect
-  gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
-)
\ No newline at end of file
+	github.com/kr/text v0.2.0 // indirect
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+)
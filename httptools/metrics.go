@@ -0,0 +1,273 @@
+package httptools
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry collects the metrics of the process. It serves them in
+// the Prometheus text exposition format and is meant to be mounted at
+// /metrics.
+var DefaultRegistry = NewRegistry()
+
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+	series           map[string]*series
+	collect          func() float64
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Registry is a set of metric families.
+type Registry struct {
+	sync.Mutex
+	families []*family
+	hooks    []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f *family) *family {
+	r.Lock()
+	defer r.Unlock()
+	for _, registered := range r.families {
+		if registered.name == f.name {
+			panic(fmt.Sprintf("metric %s registered twice", f.name))
+		}
+	}
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// OnScrape registers f to be run before every scrape, which is the place
+// to update gauges mirroring some state.
+func (r *Registry) OnScrape(f func()) {
+	r.Lock()
+	defer r.Unlock()
+	r.hooks = append(r.hooks, f)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	r *Registry
+	f *family
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r, r.register(&family{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.r.Lock()
+	defer c.r.Unlock()
+	c.f.get(values).value += v
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	r *Registry
+	f *family
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r, r.register(&family{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.r.Lock()
+	defer g.r.Unlock()
+	g.f.get(values).value = v
+}
+
+func (g *GaugeVec) Add(v float64, values ...string) {
+	g.r.Lock()
+	defer g.r.Unlock()
+	g.f.get(values).value += v
+}
+
+// Reset drops all the series, e.g. before setting the ones of the
+// currently known backends.
+func (g *GaugeVec) Reset() {
+	g.r.Lock()
+	defer g.r.Unlock()
+	g.f.series = make(map[string]*series)
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	r *Registry
+	f *family
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r, r.register(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.r.Lock()
+	defer h.r.Unlock()
+	s := h.f.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.f.buckets))
+	}
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince records the time elapsed since start in seconds.
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// CounterFunc and GaugeFunc register metrics without labels whose value is
+// read by f on every scrape.
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.register(&family{name: name, help: help, kind: "counter", collect: f})
+}
+
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(&family{name: name, help: help, kind: "gauge", collect: f})
+}
+
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("content-type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	_ = r.Write(rw)
+}
+
+// Write renders all the metrics in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	hooks := r.hooks
+	r.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	var b strings.Builder
+	for _, f := range r.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+		if f.collect != nil {
+			fmt.Fprintf(&b, "%s %s\n", f.name, formatValue(f.collect()))
+			continue
+		}
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatValue(s.value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", formatValue(bound)), s.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatValue(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.values, "", ""), s.count)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	httpRequests = DefaultRegistry.Counter("http_requests_total",
+		"Requests handled by the HTTP server.", "method", "code")
+	httpDuration = DefaultRegistry.Histogram("http_request_duration_seconds",
+		"Latency of the requests handled by the HTTP server.", DefaultBuckets, "method")
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument counts the requests served by handler and their latency in
+// DefaultRegistry.
+func Instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{rw, http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		httpRequests.Inc(r.Method, strconv.Itoa(recorder.status))
+		httpDuration.ObserveSince(start, r.Method)
+	})
+}
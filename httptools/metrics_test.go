@@ -0,0 +1,52 @@
+package httptools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests.", "backend", "code")
+	connections := r.Gauge("connections", "Connections.", "backend")
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "backend")
+	r.GaugeFunc("segments", "Segments.", func() float64 { return 3 })
+	r.OnScrape(func() {
+		connections.Reset()
+		connections.Set(2, `b"2`)
+	})
+
+	requests.Inc("b1", "200")
+	requests.Add(2, "b1", "200")
+	requests.Inc("b0", "error")
+	connections.Set(5, "stale")
+	latency.Observe(0.05, "b1")
+	latency.Observe(0.5, "b1")
+	latency.Observe(5, "b1")
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{backend="b0",code="error"} 1
+requests_total{backend="b1",code="200"} 3
+# HELP connections Connections.
+# TYPE connections gauge
+connections{backend="b\"2"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{backend="b1",le="0.1"} 1
+latency_seconds_bucket{backend="b1",le="1"} 2
+latency_seconds_bucket{backend="b1",le="+Inf"} 3
+latency_seconds_sum{backend="b1"} 5.55
+latency_seconds_count{backend="b1"} 3
+# HELP segments Segments.
+# TYPE segments gauge
+segments 3
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
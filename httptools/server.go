@@ -1,6 +1,7 @@
 package httptools
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +10,9 @@ import (
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits for the active
+	// requests to finish until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -17,14 +21,43 @@ type server struct {
 
 func (s server) Start() {
 	go func() {
-		log.Println("Starting the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			log.Println("Starting the HTTPS server...")
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Starting the HTTP server...")
+			err = s.httpServer.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Option customizes a server made by CreateServer.
+type Option func(s *server)
+
+// Streaming lifts the read and write timeouts, which otherwise cut
+// responses lasting longer than them, and limits only the time to read the
+// request headers and to wait for the next request on a kept alive
+// connection. The handlers are then responsible for their timeouts.
+func Streaming() Option {
+	return func(s *server) {
+		s.httpServer.ReadHeaderTimeout = s.httpServer.ReadTimeout
+		s.httpServer.IdleTimeout = s.httpServer.ReadTimeout
+		s.httpServer.ReadTimeout = 0
+		s.httpServer.WriteTimeout = 0
+	}
+}
+
+func CreateServer(port int, handler http.Handler, options ...Option) Server {
+	s := server{
 		httpServer: &http.Server{
 			Addr:           fmt.Sprintf(":%d", port),
 			Handler:        handler,
@@ -33,4 +66,20 @@ func CreateServer(port int, handler http.Handler) Server {
 			MaxHeaderBytes: 1 << 20,
 		},
 	}
+	for _, option := range options {
+		option(&s)
+	}
+	return s
+}
+
+// Shutdown gracefully stops all the servers, giving their active requests
+// at most timeout to finish.
+func Shutdown(timeout time.Duration, servers ...Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server did not stop gracefully: %s", err)
+		}
+	}
 }
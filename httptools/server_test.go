@@ -0,0 +1,103 @@
+package httptools
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serve runs s on a free port and returns its address.
+func serve(t *testing.T, s Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.(server).httpServer.Serve(ln) }()
+	return ln.Addr().String()
+}
+
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s := CreateServer(0, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = rw.Write([]byte("done"))
+	}))
+	addr := serve(t, s)
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		got <- result{string(body), err}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		Shutdown(time.Second, s)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown did not wait for the active request")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	if r := <-got; r.err != nil || r.body != "done" {
+		t.Errorf("Active request got %q, %v", r.body, r.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the request finished")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Server accepts connections after the shutdown")
+	}
+}
+
+func TestStreaming_IdleTimeout(t *testing.T) {
+	s := server{httpServer: &http.Server{
+		Handler:     http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		ReadTimeout: 100 * time.Millisecond,
+	}}
+	Streaming()(&s)
+	addr := serve(t, s)
+	defer Shutdown(time.Second, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := in.ReadByte(); err == nil {
+		t.Error("Unexpected data on an idle connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("Idle connection is kept open")
+	}
+}
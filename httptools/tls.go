@@ -0,0 +1,150 @@
+package httptools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertPair names the PEM files of a certificate and its private key.
+type CertPair struct {
+	CertFile, KeyFile string
+}
+
+// Certificates holds the certificates of a TLS listener. It picks the one
+// matching the server name the client asks for and can reload them from
+// disk while the server runs.
+type Certificates struct {
+	pairs []CertPair
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// LoadCertificates reads the certificates. The first one is served to
+// clients that don't send a known server name.
+func LoadCertificates(pairs ...CertPair) (*Certificates, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no certificates given")
+	}
+	c := &Certificates{pairs: pairs}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads all the certificates again. On error the ones loaded
+// before stay in use.
+func (c *Certificates) Reload() error {
+	modTimes := make(map[string]time.Time)
+	byName := make(map[string]*tls.Certificate)
+	var certs []*tls.Certificate
+	for _, pair := range c.pairs {
+		for _, path := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			modTimes[path] = info.ModTime()
+		}
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %s", pair.CertFile, err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parsing %s: %s", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, taken := byName[name]; !taken {
+				byName[name] = &cert
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certs = certs
+	c.byName = byName
+	c.modTimes = modTimes
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
+
+func (c *Certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for path, modTime := range c.modTimes {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificates whenever their files change, checking
+// every interval until stop is closed, or forever if it is nil.
+func (c *Certificates) Watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if c.changed() {
+					c.reload()
+				}
+			}
+		}
+	}()
+}
+
+func (c *Certificates) reload() {
+	if err := c.Reload(); err != nil {
+		log.Printf("Failed to reload TLS certificates: %s", err)
+		return
+	}
+	log.Println("Reloaded TLS certificates")
+}
+
+// TLS makes the server accept TLS connections only, presenting certs.
+func TLS(certs *Certificates) Option {
+	return func(s *server) {
+		s.httpServer.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+}
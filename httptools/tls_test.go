@@ -0,0 +1,120 @@
+package httptools
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, dir, name string, dnsNames ...string) CertPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := CertPair{filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(pair.CertFile, certPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.KeyFile, keyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func served(t *testing.T, certs *Certificates, serverName string) string {
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := writeCert(t, dir, "first", "lb.example.com")
+	second := writeCert(t, dir, "second", "api.example.com", "*.api.example.com")
+	certs, err := LoadCertificates(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sni", func(t *testing.T) {
+		for serverName, expected := range map[string]string{
+			"lb.example.com":      "lb.example.com",
+			"API.example.com":     "api.example.com",
+			"v1.api.example.com":  "api.example.com",
+			"":                    "lb.example.com",
+			"unknown.example.com": "lb.example.com",
+		} {
+			if name := served(t, certs, serverName); name != expected {
+				t.Errorf("Got %s for %q, expected %s", name, serverName, expected)
+			}
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		stop := make(chan struct{})
+		defer close(stop)
+		certs.Watch(10*time.Millisecond, stop)
+
+		if certs.changed() {
+			t.Fatal("Certificates changed before rewriting")
+		}
+		later := time.Now().Add(time.Minute)
+		writeCert(t, dir, "first", "www.example.com")
+		_ = os.Chtimes(first.CertFile, later, later)
+		_ = os.Chtimes(first.KeyFile, later, later)
+
+		for i := 0; i < 100 && served(t, certs, "") != "www.example.com"; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if name := served(t, certs, ""); name != "www.example.com" {
+			t.Errorf("Certificate was not reloaded, still serving %s", name)
+		}
+	})
+
+	t.Run("broken reload", func(t *testing.T) {
+		if err := ioutil.WriteFile(second.KeyFile, []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := certs.Reload(); err == nil {
+			t.Error("Reloaded a broken key")
+		}
+		if name := served(t, certs, "api.example.com"); name != "api.example.com" {
+			t.Errorf("Lost the certificate after a failed reload, serving %s", name)
+		}
+	})
+}
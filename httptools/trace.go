@@ -0,0 +1,124 @@
+package httptools
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// RequestIDHeader carries an identifier of the client request that is
+	// passed to every service taking part in serving it.
+	RequestIDHeader = "X-Request-ID"
+	// TraceparentHeader is the W3C Trace Context header, see
+	// https://www.w3.org/TR/trace-context/.
+	TraceparentHeader = "traceparent"
+)
+
+// Trace identifies a request across services. SpanID stands for the work
+// of this service on it, which is the parent of the requests it sends.
+type Trace struct {
+	RequestID string
+	TraceID   string
+	SpanID    string
+	ParentID  string
+	Flags     string
+}
+
+// Traceparent returns the traceparent header of the requests sent on
+// behalf of the traced one.
+func (t Trace) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%s", t.TraceID, t.SpanID, t.Flags)
+}
+
+// Inject sets the trace headers of a request sent on behalf of the traced
+// one.
+func (t Trace) Inject(header http.Header) {
+	header.Set(RequestIDHeader, t.RequestID)
+	header.Set(TraceparentHeader, t.Traceparent())
+}
+
+type traceKey struct{}
+
+// TraceFrom returns the trace of the request ctx belongs to.
+func TraceFrom(ctx context.Context) (Trace, bool) {
+	trace, ok := ctx.Value(traceKey{}).(Trace)
+	return trace, ok
+}
+
+// Tracing continues the trace of the incoming requests or starts a new one,
+// generating the request ID if the client sent none. The request headers
+// are rewritten to be passed on as they are, so a proxy needs nothing else,
+// and the request ID is returned to the client.
+func Tracing(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		trace := NewTrace(r.Header)
+		r = r.WithContext(context.WithValue(r.Context(), traceKey{}, trace))
+		trace.Inject(r.Header)
+		rw.Header().Set(RequestIDHeader, trace.RequestID)
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// NewTrace continues the trace the header belongs to or starts a new one.
+func NewTrace(header http.Header) Trace {
+	trace := Trace{RequestID: header.Get(RequestIDHeader), SpanID: randomHex(8)}
+	if !validRequestID(trace.RequestID) {
+		trace.RequestID = randomHex(16)
+	}
+	if traceID, parentID, flags, ok := parseTraceparent(header.Get(TraceparentHeader)); ok {
+		trace.TraceID, trace.ParentID, trace.Flags = traceID, parentID, flags
+	} else {
+		trace.TraceID, trace.Flags = randomHex(16), "01"
+	}
+	return trace
+}
+
+// validRequestID rejects the IDs that would be unsafe to log or pass on.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceparent reads a traceparent header, accepting the future
+// versions as the specification asks.
+func parseTraceparent(value string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || parts[0] == "ff" || !isHex(parts[0], 2) || parts[0] == "00" && len(parts) != 4 {
+		return "", "", "", false
+	}
+	traceID, parentID, flags = parts[1], parts[2], parts[3]
+	if !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(flags, 2) ||
+		traceID == strings.Repeat("0", 32) || parentID == strings.Repeat("0", 16) {
+		return "", "", "", false
+	}
+	return traceID, parentID, flags, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,62 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	var got Trace
+	var forwarded http.Header
+	h := Tracing(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got, _ = TraceFrom(r.Context())
+		forwarded = r.Header.Clone()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "request-1")
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if got.RequestID != "request-1" || got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		got.ParentID != "00f067aa0ba902b7" || got.Flags != "01" {
+		t.Errorf("Unexpected trace %+v", got)
+	}
+	if got.SpanID == got.ParentID || len(got.SpanID) != 16 {
+		t.Errorf("Unexpected span %s", got.SpanID)
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + got.SpanID + "-01"; forwarded.Get(TraceparentHeader) != want {
+		t.Errorf("Forwarded traceparent %s, want %s", forwarded.Get(TraceparentHeader), want)
+	}
+	if rw.Header().Get(RequestIDHeader) != "request-1" {
+		t.Errorf("Unexpected response request ID %q", rw.Header().Get(RequestIDHeader))
+	}
+
+	for _, traceparent := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, "bad id")
+		req.Header.Set(TraceparentHeader, traceparent)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got.TraceID == "4bf92f3577b34da6a3ce929d0e0e4736" || len(got.TraceID) != 32 || got.ParentID != "" {
+			t.Errorf("Continued invalid traceparent %q: %+v", traceparent, got)
+		}
+		if len(got.RequestID) != 32 {
+			t.Errorf("Kept invalid request ID: %q", got.RequestID)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(TraceparentHeader, "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.Flags != "00" {
+		t.Errorf("Rejected a future version: %+v", got)
+	}
+}
@@ -0,0 +1,21 @@
+package signal
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// OnHangup calls f every time the process receives SIGHUP, the usual
+// request to reload the configuration.
+func OnHangup(f func()) {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+	go func() {
+		for range hupChannel {
+			log.Println("Reloading...")
+			f()
+		}
+	}()
+}
@@ -8,8 +8,11 @@ import (
 )
 
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
+	// A second signal terminates the process without waiting for the
+	// graceful shutdown.
+	signal.Stop(intChannel)
 	log.Println("Shutting down...")
 }